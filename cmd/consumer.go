@@ -4,9 +4,13 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"time"
+
 	"kafka-notify/pkg/consumer"
+	"kafka-notify/pkg/store"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // consumerCmd represents the consumer command
@@ -24,6 +28,45 @@ to quickly create a Cobra application.`,
 
 func init() {
 	rootCmd.AddCommand(consumerCmd)
+
+	consumerCmd.Flags().String("store", store.BackendMemory, "Notification store backend (memory, bolt)")
+	viper.BindPFlag("store", consumerCmd.Flags().Lookup("store"))
+
+	consumerCmd.Flags().String("store-path", "notifications.db", "Database file used by the bolt store")
+	viper.BindPFlag("store-path", consumerCmd.Flags().Lookup("store-path"))
+
+	consumerCmd.Flags().Int("retention-max-per-user", 0, "Maximum notifications kept per user (0 disables the limit)")
+	viper.BindPFlag("retention-max-per-user", consumerCmd.Flags().Lookup("retention-max-per-user"))
+
+	consumerCmd.Flags().Duration("retention-max-age", 0, "Maximum age of stored notifications, e.g. 72h (0 disables the limit)")
+	viper.BindPFlag("retention-max-age", consumerCmd.Flags().Lookup("retention-max-age"))
+
+	consumerCmd.Flags().Int64("retention-max-bytes", 0, "Global size budget for stored notifications in bytes (0 disables the limit)")
+	viper.BindPFlag("retention-max-bytes", consumerCmd.Flags().Lookup("retention-max-bytes"))
+
+	consumerCmd.Flags().Duration("retention-interval", store.DefaultJanitorInterval, "How often the retention policy is enforced")
+	viper.BindPFlag("retention-interval", consumerCmd.Flags().Lookup("retention-interval"))
+
+	consumerCmd.Flags().Duration("dedup-window", 24*time.Hour, "How long delivered notification IDs are remembered to drop duplicates")
+	viper.BindPFlag("dedup-window", consumerCmd.Flags().Lookup("dedup-window"))
+
+	consumerCmd.Flags().Int("dedup-capacity", 1000, "Maximum notification IDs remembered per user to drop duplicates")
+	viper.BindPFlag("dedup-capacity", consumerCmd.Flags().Lookup("dedup-capacity"))
+
+	consumerCmd.Flags().Int("commit-batch-size", 100, "Commit consumed offsets after this many messages per partition")
+	viper.BindPFlag("commit-batch-size", consumerCmd.Flags().Lookup("commit-batch-size"))
+
+	consumerCmd.Flags().Duration("commit-interval", time.Second, "Commit consumed offsets at least this often (0 only commits full batches)")
+	viper.BindPFlag("commit-interval", consumerCmd.Flags().Lookup("commit-interval"))
+
+	consumerCmd.Flags().String("advertise-address", "", "HTTP address other consumer instances forward queries to (default http://<hostname>:8081)")
+	viper.BindPFlag("advertise-address", consumerCmd.Flags().Lookup("advertise-address"))
+
+	consumerCmd.Flags().String("routing", consumer.RoutingProxy, "How queries about users of another instance's partitions are routed (proxy, redirect, off)")
+	viper.BindPFlag("routing", consumerCmd.Flags().Lookup("routing"))
+
+	consumerCmd.Flags().String("ws-auth-token", "", "Bearer token shared by all WebSocket clients (empty disables authentication); there is no per-user authorization, any client holding it may subscribe to any user")
+	viper.BindPFlag("ws-auth-token", consumerCmd.Flags().Lookup("ws-auth-token"))
 }
 
 func runConsumer(cmd *cobra.Command, args []string) {
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"kafka-notify/pkg/dlq"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// dlqCmd groups the commands that work on the dead-letter topic
+var dlqCmd = &cobra.Command{
+	Use:   "dlq",
+	Short: "Inspect and re-drive dead-lettered notifications",
+	Long: `Messages the consumer cannot process are forwarded to the dead-letter topic
+with headers describing the error and their original topic, partition and offset.
+
+Use "dlq list" to inspect them and "dlq redrive" to publish them back to their
+original topic once the cause has been fixed.`,
+}
+
+// dlqListCmd prints the messages held in the dead-letter topic
+var dlqListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the messages in the dead-letter topic",
+	Run:   runDLQList,
+}
+
+// dlqRedriveCmd publishes dead-lettered messages back to their original topic
+var dlqRedriveCmd = &cobra.Command{
+	Use:   "redrive",
+	Short: "Publish dead-lettered messages back to their original topic",
+	Run:   runDLQRedrive,
+}
+
+func init() {
+	rootCmd.AddCommand(dlqCmd)
+	dlqCmd.AddCommand(dlqListCmd)
+	dlqCmd.AddCommand(dlqRedriveCmd)
+
+	dlqListCmd.Flags().Int("limit", 100, "Maximum messages to list (0 lists all)")
+
+	dlqRedriveCmd.Flags().Int32("partition", -1, "Only redrive messages from this dead-letter partition (-1 for all)")
+	dlqRedriveCmd.Flags().Int64("offset", -1, "Only redrive the message at this dead-letter offset (-1 for all)")
+}
+
+func runDLQList(cmd *cobra.Command, args []string) {
+	limit, _ := cmd.Flags().GetInt("limit")
+	entries, err := dlq.Read([]string{viper.GetString("kafka-broker-address")}, viper.GetString("dlq-topic"), limit)
+	if err != nil {
+		logger.Fatal("Failed to read dead-letter topic", "error", err)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(entries); err != nil {
+		logger.Fatal("Failed to print dead letters", "error", err)
+	}
+}
+
+func runDLQRedrive(cmd *cobra.Command, args []string) {
+	partition, _ := cmd.Flags().GetInt32("partition")
+	offset, _ := cmd.Flags().GetInt64("offset")
+	brokers := []string{viper.GetString("kafka-broker-address")}
+
+	entries, err := dlq.Read(brokers, viper.GetString("dlq-topic"), 0)
+	if err != nil {
+		logger.Fatal("Failed to read dead-letter topic", "error", err)
+	}
+
+	// Keep only the selected dead letters
+	selected := entries[:0]
+	for _, entry := range entries {
+		if partition >= 0 && entry.Partition != partition {
+			continue
+		}
+		if offset >= 0 && entry.Offset != offset {
+			continue
+		}
+		selected = append(selected, entry)
+	}
+
+	redriven, err := dlq.Redrive(brokers, selected)
+	if err != nil {
+		logger.Fatal("Failed to redrive dead letters", "redriven", redriven, "error", err)
+	}
+	fmt.Printf("Redrove %d of %d dead-lettered messages\n", redriven, len(selected))
+}
@@ -4,9 +4,12 @@ Copyright © 2024 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"kafka-notify/pkg/directory"
 	"kafka-notify/pkg/producer"
+	"kafka-notify/pkg/ratelimit"
 
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 // producerCmd represents the producer command
@@ -24,6 +27,42 @@ to quickly create a Cobra application.`,
 
 func init() {
 	rootCmd.AddCommand(producerCmd)
+
+	producerCmd.Flags().String("users", directory.BackendStatic, "User directory backend (static, file, sqlite, http)")
+	viper.BindPFlag("users", producerCmd.Flags().Lookup("users"))
+
+	producerCmd.Flags().String("users-source", "", "User directory source: JSON/YAML file path, SQLite database path or base URL")
+	viper.BindPFlag("users-source", producerCmd.Flags().Lookup("users-source"))
+
+	producerCmd.Flags().Duration("users-cache-ttl", directory.DefaultCacheTTL, "How long the http user directory caches lookups")
+	viper.BindPFlag("users-cache-ttl", producerCmd.Flags().Lookup("users-cache-ttl"))
+
+	producerCmd.Flags().Bool("async", false, "Queue /send notifications on an async producer and answer 202 Accepted")
+	viper.BindPFlag("async", producerCmd.Flags().Lookup("async"))
+
+	producerCmd.Flags().String("outbox-path", "", "Outbox database file; when set /send writes to it and a relay publishes to Kafka")
+	viper.BindPFlag("outbox-path", producerCmd.Flags().Lookup("outbox-path"))
+
+	producerCmd.Flags().String("scheduler-path", "scheduled.db", "Database file holding the notifications sent with a future deliver_at")
+	viper.BindPFlag("scheduler-path", producerCmd.Flags().Lookup("scheduler-path"))
+
+	producerCmd.Flags().String("rate-limits", "", "JSON/YAML file with the /send rate limits per sender, recipient and kind (no limits when empty)")
+	viper.BindPFlag("rate-limits", producerCmd.Flags().Lookup("rate-limits"))
+
+	producerCmd.Flags().String("rate-limiter", ratelimit.BackendMemory, "Rate limiter backend (memory, sqlite)")
+	viper.BindPFlag("rate-limiter", producerCmd.Flags().Lookup("rate-limiter"))
+
+	producerCmd.Flags().String("rate-limiter-source", "", "SQLite database shared by the producers using the sqlite rate limiter")
+	viper.BindPFlag("rate-limiter-source", producerCmd.Flags().Lookup("rate-limiter-source"))
+
+	producerCmd.Flags().Bool("idempotent", false, "Enable the idempotent producer (acks=all, no duplicates on retries)")
+	viper.BindPFlag("idempotent", producerCmd.Flags().Lookup("idempotent"))
+
+	producerCmd.Flags().Int("max-in-flight", 0, "Maximum unacknowledged requests per broker connection (0 uses the default, 1 when idempotent)")
+	viper.BindPFlag("max-in-flight", producerCmd.Flags().Lookup("max-in-flight"))
+
+	producerCmd.Flags().String("transactional-id", "", "Transactional ID enabling exactly-once multi-recipient sends at /send/transactional")
+	viper.BindPFlag("transactional-id", producerCmd.Flags().Lookup("transactional-id"))
 }
 
 func runProducer(cmd *cobra.Command, args []string) {
@@ -56,6 +56,9 @@ func init() {
 	rootCmd.PersistentFlags().StringP("kafka-broker-address", "k", "192.168.5.142:9092", "Kafka broker address")
 	viper.BindPFlag("kafka-broker-address", rootCmd.PersistentFlags().Lookup("kafka-broker-address"))
 
+	rootCmd.PersistentFlags().String("dlq-topic", "notifications-dlq", "Dead-letter topic for messages the consumer cannot process")
+	viper.BindPFlag("dlq-topic", rootCmd.PersistentFlags().Lookup("dlq-topic"))
+
 }
 
 func persistentPreRun(cmd *cobra.Command, args []string) {
@@ -0,0 +1,72 @@
+package consumer
+
+import (
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// CommitPolicy decides when the offsets of processed messages are committed to Kafka
+// Committing in batches saves a broker round trip per message; a crash before the
+// commit only redelivers messages the store already recorded, which are skipped
+type CommitPolicy struct {
+	Messages int           // Commit after this many messages of a partition, 0 or 1 commits every message
+	Interval time.Duration // Commit pending offsets at least this often, 0 waits for Messages
+}
+
+// committer commits the offsets marked on a partition according to the commit policy
+type committer struct {
+	sess      sarama.ConsumerGroupSession
+	policy    CommitPolicy
+	partition int32
+	metrics   *Metrics
+	pending   int
+	next      int64 // Offset after the last processed message
+	ticker    *time.Ticker
+}
+
+// newCommitter starts tracking the processed messages of a claim, reporting the
+// committed offsets to metrics
+func newCommitter(sess sarama.ConsumerGroupSession, policy CommitPolicy,
+	partition int32, metrics *Metrics) *committer {
+	c := &committer{sess: sess, policy: policy, partition: partition, metrics: metrics}
+	if policy.Interval > 0 {
+		c.ticker = time.NewTicker(policy.Interval)
+	}
+	return c
+}
+
+// processed records a marked message and commits when the batch is full
+func (c *committer) processed(offset int64) {
+	c.pending++
+	c.next = offset + 1
+	if c.pending >= c.policy.Messages {
+		c.commit()
+	}
+}
+
+// tick returns the channel signaling that pending offsets are due, nil without an interval
+func (c *committer) tick() <-chan time.Time {
+	if c.ticker == nil {
+		return nil
+	}
+	return c.ticker.C
+}
+
+// commit sends the marked offsets to Kafka when there are any
+func (c *committer) commit() {
+	if c.pending == 0 {
+		return
+	}
+	c.sess.Commit()
+	c.metrics.committed(c.partition, c.next)
+	c.pending = 0
+}
+
+// stop commits the pending offsets and releases the ticker
+func (c *committer) stop() {
+	c.commit()
+	if c.ticker != nil {
+		c.ticker.Stop()
+	}
+}
@@ -2,15 +2,18 @@ package consumer
 
 import (
 	"context"
-	"sync"
+	"os"
+	"strings"
 	"time"
 
-	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/metrics"
 	"kafka-notify/pkg/server"
+	"kafka-notify/pkg/store"
 
 	"github.com/alejoacosta74/go-logger"
 
 	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/spf13/viper"
 )
 
@@ -20,55 +23,94 @@ const (
 	ConsumerPort  = ":8081"
 )
 
-var KafkaServerAddress string
-
-// UserNotifications is a custom type that maps user IDs to their slice of notifications
-// This allows efficient storage and retrieval of notifications per user
-type UserNotifications map[string][]models.Notification
+var (
+	KafkaServerAddress string
+	DeadLetterTopic    string
+)
 
-// NotificationStore provides thread-safe storage of user notifications
-// Uses a mutex to safely handle concurrent access to the data
-type NotificationStore struct {
-	data UserNotifications // Holds the actual notification data
-	mu   sync.RWMutex      // RWMutex allows multiple readers but only one writer
-}
+func Run() {
+	KafkaServerAddress = viper.GetString("kafka-broker-address")
+	DeadLetterTopic = viper.GetString("dlq-topic")
 
-// Add safely adds a new notification to a user's notification list
-// Uses a write lock to ensure thread-safe updates to the data
-func (ns *NotificationStore) Add(userID string,
-	notification models.Notification) {
-	ns.mu.Lock()                                            // Acquire exclusive write lock
-	defer ns.mu.Unlock()                                    // Release lock when function returns
-	ns.data[userID] = append(ns.data[userID], notification) // Append new notification to user's list
-}
+	// Open the notification store for the configured backend
+	backend := viper.GetString("store")
+	notificationStore, err := store.Open(backend, viper.GetString("store-path"))
+	if err != nil {
+		logger.Fatal("Failed to open notification store", "backend", backend, "error", err)
+	}
+	defer notificationStore.Close()
 
-// Get safely retrieves all notifications for a given user
-// Uses a read lock since it's not modifying data
-func (ns *NotificationStore) Get(userID string) []models.Notification {
-	ns.mu.RLock()          // Acquire shared read lock
-	defer ns.mu.RUnlock()  // Release lock when function returns
-	return ns.data[userID] // Return user's notifications
-}
+	// Initialize hub to push new notifications to live streams
+	hub := NewHub()
+	// Initialize deduplicator to drop redelivered notifications
+	deduper := NewDeduplicator(viper.GetDuration("dedup-window"), viper.GetInt("dedup-capacity"))
 
-func Run() {
-	KafkaServerAddress = viper.GetString("kafka-broker-address")
+	// Commit offsets in batches, only once the store has persisted the messages
+	commits := CommitPolicy{
+		Messages: viper.GetInt("commit-batch-size"),
+		Interval: viper.GetDuration("commit-interval"),
+	}
 
-	// Initialize notification store with empty map
-	store := &NotificationStore{
-		data: make(UserNotifications),
+	// Route the queries about users of partitions owned by other instances to them
+	router, err := NewRouter(advertisedAddress(), viper.GetString("routing"), ConsumerTopic)
+	if err != nil {
+		logger.Fatal("Failed to configure query routing", "error", err)
 	}
+	// Track the claimed partitions while their history is loaded after a rebalance
+	partitions := NewPartitionStates()
+	// Measure the lag and throughput of the claimed partitions
+	consumerMetrics := NewMetrics(ConsumerTopic)
+	prometheus.MustRegister(consumerMetrics)
+	// Report the size of the store
+	metrics.RegisterStore(notificationStore)
 
 	// Create cancellable context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	// Start Kafka consumer group in separate goroutine
-	go setupConsumerGroup(ctx, store)
+	consumerDone := make(chan struct{})
+	go func() {
+		setupConsumerGroup(ctx, notificationStore, hub, deduper, commits, router, partitions, consumerMetrics)
+		close(consumerDone)
+	}()
 	// Ensure context is cancelled when main exits
 	defer cancel()
 
+	// Start the retention janitor when a policy is configured
+	janitor := setupJanitor(ctx, notificationStore)
+
 	// create and start http server to expose the consumer endpoint
 	httpServer := server.NewServer(ConsumerPort)
-	httpServer.Get("/notifications/:userID", func(ctx *gin.Context) {
-		handleNotifications(ctx, store)
+	// Queries about a user are answered by the instance owning the user's partition
+	httpServer.Get("/notifications/:userID", router.Route(), func(ctx *gin.Context) {
+		handleNotifications(ctx, notificationStore)
+	})
+	httpServer.Post("/notifications/:userID/read", router.Route(), func(ctx *gin.Context) {
+		handleMarkRead(ctx, notificationStore)
+	})
+	httpServer.Get("/notifications/:userID/unread-count", router.Route(), func(ctx *gin.Context) {
+		handleUnreadCount(ctx, notificationStore)
+	})
+	// Live streams are closed when ctx is cancelled so shutdown is not blocked
+	// They are routed when they connect, the owner is the instance pushing the user's notifications
+	httpServer.Get("/notifications/:userID/stream", router.Route(), func(ginCtx *gin.Context) {
+		handleNotificationStream(ginCtx, notificationStore, hub, ctx.Done())
+	})
+	// WebSocket clients subscribe to one or more users over a single connection
+	wsAuthToken := viper.GetString("ws-auth-token")
+	if wsAuthToken == "" {
+		logger.Warn("WebSocket authentication disabled: any client may subscribe to any user, set --ws-auth-token to require a token")
+	}
+	httpServer.Get("/ws", func(ginCtx *gin.Context) {
+		handleWebSocket(ginCtx, notificationStore, hub, wsAuthToken, ctx.Done())
+	})
+	httpServer.Get("/admin/retention", func(ctx *gin.Context) {
+		handleRetentionStats(ctx, janitor)
+	})
+	httpServer.Get("/admin/partitions", func(ctx *gin.Context) {
+		handlePartitionOwners(ctx, router, partitions)
+	})
+	httpServer.Get("/admin/metrics", func(ctx *gin.Context) {
+		handleConsumerMetrics(ctx, consumerMetrics)
 	})
 	httpServer.ListenAndServe()
 
@@ -77,12 +119,50 @@ func Run() {
 	interruptCh := server.NewInterruptSignalChannel()
 	<-interruptCh
 
-	// cancel the context to stop the consumer
+	// cancel the context to stop the consumer and close live streams
 	cancel()
 
-	ctxWithTimeout, _ := context.WithTimeout(ctx, 5*time.Second)
+	ctxWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelTimeout()
 	httpServer.Shutdown(ctxWithTimeout)
+	// Let the consumer commit its last offsets before the store is closed
+	<-consumerDone
 
-	<-ctx.Done()
 	logger.Info("Kafka consumer finished")
 }
+
+// advertisedAddress returns the HTTP address the other instances reach this one at
+// Defaults to the host name and the consumer port
+func advertisedAddress() string {
+	if address := viper.GetString("advertise-address"); address != "" {
+		return strings.TrimRight(address, "/")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return "http://" + host + ConsumerPort
+}
+
+// setupJanitor starts a janitor enforcing the configured retention policy
+// Returns nil when no policy is configured
+func setupJanitor(ctx context.Context, notificationStore store.Store) *store.Janitor {
+	policy := store.RetentionPolicy{
+		MaxPerUser: viper.GetInt("retention-max-per-user"),
+		MaxAge:     viper.GetDuration("retention-max-age"),
+		MaxBytes:   viper.GetInt64("retention-max-bytes"),
+	}
+	if !policy.Enabled() {
+		return nil
+	}
+	pruner, ok := notificationStore.(store.Pruner)
+	if !ok {
+		logger.Warn("Notification store does not support retention policies", "backend", viper.GetString("store"))
+		return nil
+	}
+	janitor := store.NewJanitor(pruner, policy, viper.GetDuration("retention-interval"))
+	go janitor.Run(ctx)
+	logger.Info("Retention janitor started", "maxPerUser", policy.MaxPerUser,
+		"maxAge", policy.MaxAge, "maxBytes", policy.MaxBytes)
+	return janitor
+}
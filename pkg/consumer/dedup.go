@@ -0,0 +1,103 @@
+package consumer
+
+import (
+	"sync"
+	"time"
+
+	"kafka-notify/pkg/models"
+)
+
+// Deduplicator remembers the notifications recently delivered to each user so
+// Kafka redeliveries and producer retries are not shown twice
+// Each user keeps at most capacity keys, and keys older than window are forgotten
+type Deduplicator struct {
+	window   time.Duration
+	capacity int
+
+	mu   sync.Mutex
+	seen map[string]*seenSet
+}
+
+// seenSet holds the keys seen for one user in arrival order
+type seenSet struct {
+	keys  map[string]time.Time
+	order []seenEntry
+}
+
+type seenEntry struct {
+	key    string
+	seenAt time.Time
+}
+
+// NewDeduplicator creates a deduplicator with the given time window and per-user capacity
+func NewDeduplicator(window time.Duration, capacity int) *Deduplicator {
+	return &Deduplicator{
+		window:   window,
+		capacity: capacity,
+		seen:     make(map[string]*seenSet),
+	}
+}
+
+// DedupKey returns the key used to detect duplicates of a notification:
+// the producer-supplied idempotency key when present, otherwise its ID
+func DedupKey(notification models.Notification) string {
+	if notification.IdempotencyKey != "" {
+		return notification.IdempotencyKey
+	}
+	return notification.ID
+}
+
+// IsDuplicate reports whether the key was already delivered to the user within the window
+func (d *Deduplicator) IsDuplicate(userID, key string, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	set, ok := d.seen[userID]
+	if !ok {
+		return false
+	}
+	d.expire(userID, set, now)
+	_, ok = set.keys[key]
+	return ok
+}
+
+// Remember records that the key was delivered to the user
+// Call it only once the notification is stored, so a failed write is retried
+func (d *Deduplicator) Remember(userID, key string, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	set, ok := d.seen[userID]
+	if !ok {
+		set = &seenSet{keys: make(map[string]time.Time)}
+		d.seen[userID] = set
+	}
+	if _, ok := set.keys[key]; ok {
+		return
+	}
+	set.keys[key] = now
+	set.order = append(set.order, seenEntry{key: key, seenAt: now})
+
+	// Enforce the per-user bound, dropping the oldest keys first
+	for len(set.order) > d.capacity {
+		delete(set.keys, set.order[0].key)
+		set.order = set.order[1:]
+	}
+	d.expire(userID, set, now)
+}
+
+// expire forgets the keys that fell out of the window
+// Must be called with the lock held
+func (d *Deduplicator) expire(userID string, set *seenSet, now time.Time) {
+	i := 0
+	for i < len(set.order) && now.Sub(set.order[i].seenAt) > d.window {
+		delete(set.keys, set.order[i].key)
+		i++
+	}
+	if i == 0 {
+		return
+	}
+	// Copy the survivors so the dropped entries can be garbage collected
+	set.order = append([]seenEntry(nil), set.order[i:]...)
+	if len(set.order) == 0 {
+		delete(d.seen, userID)
+	}
+}
@@ -0,0 +1,47 @@
+package consumer
+
+import (
+	"testing"
+	"time"
+
+	"kafka-notify/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeduplicatorDetectsRememberedKeys(t *testing.T) {
+	d := NewDeduplicator(time.Hour, 10)
+	now := time.Now()
+
+	assert.False(t, d.IsDuplicate("1", "a", now))
+	d.Remember("1", "a", now)
+	assert.True(t, d.IsDuplicate("1", "a", now))
+	// Keys are tracked per user
+	assert.False(t, d.IsDuplicate("2", "a", now))
+}
+
+func TestDeduplicatorForgetsKeysOutsideTheWindow(t *testing.T) {
+	d := NewDeduplicator(time.Minute, 10)
+	now := time.Now()
+	d.Remember("1", "a", now)
+
+	assert.True(t, d.IsDuplicate("1", "a", now.Add(time.Minute)))
+	assert.False(t, d.IsDuplicate("1", "a", now.Add(time.Minute+time.Second)))
+}
+
+func TestDeduplicatorBoundsKeysPerUser(t *testing.T) {
+	d := NewDeduplicator(time.Hour, 2)
+	now := time.Now()
+	d.Remember("1", "a", now)
+	d.Remember("1", "b", now)
+	d.Remember("1", "c", now)
+
+	assert.False(t, d.IsDuplicate("1", "a", now), "oldest key dropped first")
+	assert.True(t, d.IsDuplicate("1", "b", now))
+	assert.True(t, d.IsDuplicate("1", "c", now))
+}
+
+func TestDedupKeyPrefersIdempotencyKey(t *testing.T) {
+	assert.Equal(t, "id", DedupKey(models.Notification{ID: "id"}))
+	assert.Equal(t, "key", DedupKey(models.Notification{ID: "id", IdempotencyKey: "key"}))
+}
@@ -0,0 +1,246 @@
+package consumer
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"kafka-notify/pkg/store"
+
+	"github.com/IBM/sarama"
+	"github.com/alejoacosta74/go-logger"
+)
+
+// Hand-off statuses of the partitions claimed by this instance
+const (
+	PartitionWarming = "warming" // Replaying the history consumed by the previous owner
+	PartitionReady   = "ready"   // Caught up, queries see every notification of the partition
+)
+
+// replayIdleTimeout ends a replay that stopped receiving messages before the hand-off
+// offset: transaction markers and aborted messages take offsets but are never delivered
+const replayIdleTimeout = 5 * time.Second
+
+// PartitionState reports the hand-off progress of a partition claimed by this instance
+type PartitionState struct {
+	Partition   int32     `json:"partition"`
+	Status      string    `json:"status"`
+	ReplayFrom  int64     `json:"replayFrom,omitempty"`
+	ReplayUntil int64     `json:"replayUntil,omitempty"`
+	Offset      int64     `json:"offset"` // Last offset processed, -1 when none yet
+	Since       time.Time `json:"since"`
+}
+
+// PartitionStates tracks the partitions claimed by this instance and whether their
+// history has been loaded into the store. It also remembers the last offset processed
+// on every partition, the checkpoint of the stores that do not keep one themselves
+type PartitionStates struct {
+	mu      sync.RWMutex
+	claimed map[int32]*PartitionState
+	last    map[int32]int64
+}
+
+// NewPartitionStates creates a tracker with no claimed partition
+func NewPartitionStates() *PartitionStates {
+	return &PartitionStates{claimed: make(map[int32]*PartitionState), last: make(map[int32]int64)}
+}
+
+// claim starts tracking the partitions of a new session, warming until their claim
+// has checked that the store holds their history
+func (s *PartitionStates) claim(partitions []int32) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().UTC()
+	for _, partition := range partitions {
+		offset, ok := s.last[partition]
+		if !ok {
+			offset = -1
+		}
+		s.claimed[partition] = &PartitionState{
+			Partition: partition,
+			Status:    PartitionWarming,
+			Offset:    offset,
+			Since:     now,
+		}
+	}
+}
+
+// warm records that the offsets from..until-1 of a partition are being replayed
+func (s *PartitionStates) warm(partition int32, from, until int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.claimed[partition]; ok {
+		state.Status = PartitionWarming
+		state.ReplayFrom, state.ReplayUntil = from, until
+	}
+}
+
+// ready records that a partition caught up with the offset it was handed off at
+func (s *PartitionStates) ready(partition int32) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state, ok := s.claimed[partition]; ok && state.Status != PartitionReady {
+		state.Status = PartitionReady
+		state.Since = time.Now().UTC()
+	}
+}
+
+// processed records the last offset handled on a partition
+func (s *PartitionStates) processed(partition int32, offset int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.last[partition] = offset
+	if state, ok := s.claimed[partition]; ok {
+		state.Offset = offset
+	}
+}
+
+// lastOffset returns the last offset this process handled on a partition, if any
+func (s *PartitionStates) lastOffset(partition int32) (int64, bool) {
+	if s == nil {
+		return 0, false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	offset, ok := s.last[partition]
+	return offset, ok
+}
+
+// release stops tracking the partitions of an ended session
+// Their last offsets are kept, the store still holds what was consumed
+func (s *PartitionStates) release(partitions []int32) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, partition := range partitions {
+		delete(s.claimed, partition)
+	}
+}
+
+// States returns the state of every claimed partition, ordered by partition
+func (s *PartitionStates) States() []PartitionState {
+	if s == nil {
+		return []PartitionState{}
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	states := make([]PartitionState, 0, len(s.claimed))
+	for _, state := range s.claimed {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Partition < states[j].Partition })
+	return states
+}
+
+// Warming reports whether any claimed partition is still loading its history
+func (s *PartitionStates) Warming() bool {
+	for _, state := range s.States() {
+		if state.Status == PartitionWarming {
+			return true
+		}
+	}
+	return false
+}
+
+// warmUp loads the history of a claimed partition before its live messages are consumed
+// The messages between the last one the store holds and the offset the group committed
+// were processed by the previous owner: they are replayed into the store, and the
+// partition reports warming until the replay reaches the offset the claim starts at.
+// The committed offset is left untouched, so a crash while warming loses nothing
+func (consumer *Consumer) warmUp(sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	topic, partition, until := claim.Topic(), claim.Partition(), claim.InitialOffset()
+	// A negative initial offset means nothing was committed: the claim consumes the
+	// whole partition itself
+	if consumer.client == nil || until < 0 {
+		consumer.partitions.ready(partition)
+		return nil
+	}
+	from, err := consumer.replayStart(topic, partition)
+	if err != nil {
+		return err
+	}
+	if from >= until {
+		consumer.partitions.ready(partition)
+		return nil
+	}
+	consumer.partitions.warm(partition, from, until)
+	logger.Info("Warming partition", "topic", topic, "partition", partition, "from", from, "until", until)
+
+	history, err := sarama.NewConsumerFromClient(consumer.client)
+	if err != nil {
+		return fmt.Errorf("failed to replay %s/%d: %w", topic, partition, err)
+	}
+	// Closing the consumer leaves the shared client open
+	defer history.Close()
+	partitionConsumer, err := history.ConsumePartition(topic, partition, from)
+	if err != nil {
+		return fmt.Errorf("failed to replay %s/%d: %w", topic, partition, err)
+	}
+	defer partitionConsumer.Close()
+
+	for {
+		select {
+		case msg, ok := <-partitionConsumer.Messages():
+			if !ok || msg.Offset >= until {
+				consumer.partitions.ready(partition)
+				logger.Info("Partition warmed up", "topic", topic, "partition", partition)
+				return nil
+			}
+			if err := consumer.handleMessage(sess, msg, true); err != nil {
+				return err
+			}
+			consumer.partitions.processed(msg.Partition, msg.Offset)
+			consumer.metrics.processed(msg.Partition, msg.Offset, time.Now())
+			if msg.Offset == until-1 {
+				consumer.partitions.ready(partition)
+				logger.Info("Partition warmed up", "topic", topic, "partition", partition)
+				return nil
+			}
+		case err := <-partitionConsumer.Errors():
+			return fmt.Errorf("failed to replay %s/%d: %w", topic, partition, err)
+		case <-time.After(replayIdleTimeout):
+			// Only offsets that are never delivered were left before the hand-off offset
+			consumer.partitions.ready(partition)
+			logger.Warn("Partition replay idle, assuming caught up", "topic", topic, "partition", partition)
+			return nil
+		case <-sess.Context().Done():
+			return nil
+		}
+	}
+}
+
+// replayStart returns the first offset of a partition missing from the store: the one
+// after the store's checkpoint, or after the last one this process handled for stores
+// without checkpoints, and the oldest offset still in the partition when there is none
+func (consumer *Consumer) replayStart(topic string, partition int32) (int64, error) {
+	from, err := consumer.client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read oldest offset of %s/%d: %w", topic, partition, err)
+	}
+	last, found := consumer.partitions.lastOffset(partition)
+	if checkpointer, ok := consumer.store.(store.Checkpointer); ok {
+		last, found, err = checkpointer.Checkpoint(topic, partition)
+		if err != nil {
+			return 0, fmt.Errorf("failed to read checkpoint for %s/%d: %w", topic, partition, err)
+		}
+	}
+	if found && last+1 > from {
+		from = last + 1
+	}
+	return from, nil
+}
@@ -0,0 +1,120 @@
+package consumer
+
+import (
+	"fmt"
+	"testing"
+
+	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/store"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newHistoryClient returns a client of a mock broker whose partition 0 holds the
+// notifications "old-0" to "old-<count-1>" for user 1 at offsets 0 to count-1
+func newHistoryClient(t *testing.T, count int64) sarama.Client {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+	fetch := sarama.NewMockFetchResponse(t, 1)
+	for offset := int64(0); offset < count; offset++ {
+		msg := testMessage(t, offset, "1", models.Notification{ID: fmt.Sprintf("old-%d", offset)})
+		fetch.SetMessageWithKey(testTopic, 0, offset, sarama.ByteEncoder(msg.Key), sarama.ByteEncoder(msg.Value))
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{
+		"MetadataRequest": sarama.NewMockMetadataResponse(t).
+			SetBroker(broker.Addr(), broker.BrokerID()).
+			SetLeader(testTopic, 0, broker.BrokerID()),
+		"OffsetRequest": sarama.NewMockOffsetResponse(t).
+			SetOffset(testTopic, 0, sarama.OffsetOldest, 0).
+			SetOffset(testTopic, 0, sarama.OffsetNewest, count),
+		"FetchRequest": fetch,
+	})
+
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// newHandoffClaim returns a claim of partition 0 starting at initialOffset that
+// delivers msgs and then ends
+func newHandoffClaim(initialOffset int64, msgs ...*sarama.ConsumerMessage) *testClaim {
+	claim := newTestClaim(msgs...)
+	claim.initialOffset = initialOffset
+	return claim
+}
+
+func TestPartitionStatesTrackHandoff(t *testing.T) {
+	states := NewPartitionStates()
+	states.claim([]int32{0, 1})
+	assert.True(t, states.Warming())
+
+	states.warm(0, 5, 10)
+	states.ready(1)
+	claimed := states.States()
+	require.Len(t, claimed, 2)
+	assert.Equal(t, PartitionState{Partition: 0, Status: PartitionWarming, ReplayFrom: 5, ReplayUntil: 10,
+		Offset: -1, Since: claimed[0].Since}, claimed[0])
+	assert.Equal(t, PartitionReady, claimed[1].Status)
+
+	states.processed(0, 9)
+	states.ready(0)
+	assert.False(t, states.Warming())
+	assert.Equal(t, int64(9), states.States()[0].Offset)
+
+	// Released partitions are no longer reported but their last offset is kept
+	states.release([]int32{0, 1})
+	assert.Empty(t, states.States())
+	offset, ok := states.lastOffset(0)
+	assert.True(t, ok)
+	assert.Equal(t, int64(9), offset)
+}
+
+func TestConsumeClaimReplaysHandedOverHistory(t *testing.T) {
+	notificationStore := store.NewMemoryStore()
+	consumer := newTestConsumer(notificationStore)
+	consumer.partitions = NewPartitionStates()
+	consumer.client = newHistoryClient(t, 3)
+	live := consumer.hub.Subscribe("1")
+	defer live.Close()
+
+	sess := newTestSession(0)
+	require.NoError(t, consumer.Setup(sess))
+	assert.True(t, consumer.partitions.Warming(), "claimed partitions warm until their history is checked")
+
+	// The previous owner consumed offsets 0 to 2, the claim resumes at 3
+	claim := newHandoffClaim(3, testMessage(t, 3, "1", models.Notification{ID: "live"}))
+	require.NoError(t, consumer.ConsumeClaim(sess, claim))
+
+	stored, err := notificationStore.List("1")
+	require.NoError(t, err)
+	ids := make([]string, 0, len(stored))
+	for _, notification := range stored {
+		ids = append(ids, notification.ID)
+	}
+	assert.Equal(t, []string{"old-0", "old-1", "old-2", "live"}, ids)
+	// Replayed messages were already committed by the previous owner and pushed to its streams
+	assert.Equal(t, []int64{3}, sess.marked)
+	require.Len(t, live.C, 1)
+	assert.Equal(t, "live", (<-live.C).ID)
+
+	states := consumer.partitions.States()
+	require.Len(t, states, 1)
+	assert.Equal(t, PartitionReady, states[0].Status)
+	assert.Equal(t, int64(0), states[0].ReplayFrom)
+	assert.Equal(t, int64(3), states[0].ReplayUntil)
+	assert.Equal(t, int64(3), states[0].Offset)
+
+	// Cleanup releases the partition, the next claim resumes after what was processed
+	require.NoError(t, consumer.Cleanup(sess))
+	assert.Empty(t, consumer.partitions.States())
+
+	require.NoError(t, consumer.Setup(sess))
+	require.NoError(t, consumer.ConsumeClaim(sess, newHandoffClaim(4)))
+	assert.False(t, consumer.partitions.Warming())
+	stored, err = notificationStore.List("1")
+	require.NoError(t, err)
+	assert.Len(t, stored, 4, "nothing is replayed twice")
+}
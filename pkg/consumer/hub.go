@@ -0,0 +1,88 @@
+package consumer
+
+import (
+	"sync"
+
+	"kafka-notify/pkg/store"
+)
+
+// SubscriptionBuffer is the number of notifications a live subscriber can fall behind
+// before it is considered too slow and gets disconnected
+const SubscriptionBuffer = 64
+
+// Subscription receives the notifications stored for a single user
+// C is closed when the subscription is cancelled or the subscriber falls behind
+type Subscription struct {
+	C      <-chan store.StoredNotification
+	ch     chan store.StoredNotification
+	userID string
+	hub    *Hub
+}
+
+// Hub fans out newly stored notifications to every live subscriber of a user
+// A user can have many subscribers at once (several browser tabs or devices)
+type Hub struct {
+	mu   sync.Mutex
+	subs map[string]map[*Subscription]struct{}
+}
+
+// NewHub creates an empty hub ready to accept subscribers
+func NewHub() *Hub {
+	return &Hub{subs: make(map[string]map[*Subscription]struct{})}
+}
+
+// Subscribe registers a new subscriber for the given user
+// The caller must call Close on the returned subscription when done
+func (h *Hub) Subscribe(userID string) *Subscription {
+	ch := make(chan store.StoredNotification, SubscriptionBuffer)
+	sub := &Subscription{C: ch, ch: ch, userID: userID, hub: h}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.subs[userID] == nil {
+		h.subs[userID] = make(map[*Subscription]struct{})
+	}
+	h.subs[userID][sub] = struct{}{}
+	return sub
+}
+
+// Publish delivers a stored notification to every subscriber of the user without blocking
+// Subscribers whose buffer is full are dropped and their channel is closed,
+// so they can reconnect and resume from the last sequence number they received
+func (h *Hub) Publish(userID string, notification store.StoredNotification) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs[userID] {
+		select {
+		case sub.ch <- notification:
+		default:
+			// Subscriber is too slow, disconnect it instead of blocking the consumer
+			h.remove(sub)
+		}
+	}
+}
+
+// Close cancels the subscription and releases its resources
+// It is safe to call Close more than once
+func (s *Subscription) Close() {
+	s.hub.mu.Lock()
+	defer s.hub.mu.Unlock()
+	s.hub.remove(s)
+}
+
+// remove unregisters a subscription and closes its channel
+// Must be called with the hub lock held
+func (h *Hub) remove(sub *Subscription) {
+	subs, ok := h.subs[sub.userID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[sub]; !ok {
+		return
+	}
+	delete(subs, sub)
+	close(sub.ch)
+	if len(subs) == 0 {
+		delete(h.subs, sub.userID)
+	}
+}
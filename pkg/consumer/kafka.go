@@ -3,56 +3,298 @@ package consumer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
+	"kafka-notify/pkg/dlq"
+	"kafka-notify/pkg/metrics"
 	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/store"
 
 	"github.com/IBM/sarama"
 	"github.com/alejoacosta74/go-logger"
 )
 
-// Consumer struct holds a reference to the notification store for persisting messages
+var (
+	// ErrMissingRecipient is returned when a message has no key to identify its recipient
+	ErrMissingRecipient = errors.New("message has no recipient key")
+	// ErrUnsupportedContentType is returned when a message is not a JSON notification
+	ErrUnsupportedContentType = errors.New("unsupported content type")
+)
+
+// Consumer struct holds a reference to the notification store for persisting messages,
+// to the hub used to push them to live subscribers, to the deduplicator that drops
+// redelivered messages, to the forwarder that dead-letters poison messages, to
+// the policy deciding when consumed offsets are committed, to the router
+// tracking which instance owns each partition, to the hand-off state of the
+// claimed partitions, to the client used to replay their history and to the
+// lag and throughput metrics
 type Consumer struct {
-	store *NotificationStore
+	store      store.Store
+	hub        *Hub
+	deduper    *Deduplicator
+	deadLetter *dlq.Forwarder
+	commits    CommitPolicy
+	router     *Router
+	partitions *PartitionStates
+	client     sarama.Client
+	metrics    *Metrics
 }
 
 // Setup is called when the consumer group session starts
-// Returns nil as no setup is needed
-func (*Consumer) Setup(sarama.ConsumerGroupSession) error { return nil }
+// Durable stores keep their own checkpoint, so a claimed partition the store has
+// recorded past the committed offset is moved forward to the offset right after it:
+// the store was written but the offset not committed yet, nothing is applied twice.
+// Partitions the store is behind on are caught up by their claim, see warmUp
+func (consumer *Consumer) Setup(sess sarama.ConsumerGroupSession) error {
+	// Learn which instance owns each partition now that the assignment is known
+	consumer.router.assign(sess, ConsumerGroup)
+	consumer.metrics.rebalanced()
+	for _, partitions := range sess.Claims() {
+		consumer.partitions.claim(partitions)
+	}
+	checkpointer, ok := consumer.store.(store.Checkpointer)
+	if !ok {
+		return nil
+	}
+	for topic, partitions := range sess.Claims() {
+		for _, partition := range partitions {
+			offset, found, err := checkpointer.Checkpoint(topic, partition)
+			if err != nil {
+				return fmt.Errorf("failed to read checkpoint for %s/%d: %w", topic, partition, err)
+			}
+			if !found {
+				continue
+			}
+			// MarkOffset only moves forward, the committed offset is never rewound
+			sess.MarkOffset(topic, partition, offset+1, "")
+		}
+	}
+	sess.Commit()
+	return nil
+}
 
 // Cleanup is called when the consumer group session ends
-// Returns nil as no cleanup is needed
-func (*Consumer) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+// Commits the offsets marked since the last commit, auto-commit is disabled,
+// forgets the partition owners until the next session and releases the claimed partitions
+func (consumer *Consumer) Cleanup(sess sarama.ConsumerGroupSession) error {
+	sess.Commit()
+	consumer.router.revoke()
+	for _, partitions := range sess.Claims() {
+		consumer.partitions.release(partitions)
+		consumer.metrics.released(partitions)
+	}
+	return nil
+}
 
 // ConsumeClaim handles the consumption of messages from a Kafka partition
 // Implements the sarama.ConsumerGroupHandler interface
+// The history of the partition is loaded first, then a message is marked once the
+// store has persisted it, and marked offsets are committed in batches according to
+// the commit policy
 func (consumer *Consumer) ConsumeClaim(
 	sess sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
-	// Continuously read messages from the claim's message channel
-	for msg := range claim.Messages() {
-		// Extract the userID from the message key
-		userID := string(msg.Key)
-		// Create a notification object to store the message data
-		var notification models.Notification
-		// Deserialize the JSON message value into the notification struct
-		err := json.Unmarshal(msg.Value, &notification)
+	consumer.metrics.claimed(claim)
+	if err := consumer.warmUp(sess, claim); err != nil {
+		return err
+	}
+	committer := newCommitter(sess, consumer.commits, claim.Partition(), consumer.metrics)
+	// Commit what was processed before the claim ends, even on error
+	defer committer.stop()
+	for {
+		select {
+		case msg, ok := <-claim.Messages():
+			if !ok {
+				return nil
+			}
+			if err := consumer.handleMessage(sess, msg, false); err != nil {
+				return err
+			}
+			consumer.partitions.processed(msg.Partition, msg.Offset)
+			consumer.metrics.processed(msg.Partition, msg.Offset, time.Now())
+			committer.processed(msg.Offset)
+		case <-committer.tick():
+			committer.commit()
+		}
+	}
+}
+
+// handleMessage stores a message, or dead-letters or skips it, and marks it as processed
+// Replayed messages were already handled by the previous owner of the partition:
+// they are only stored, never dead-lettered or pushed to live streams again
+// Returns an error when the message could not be handled and must be consumed again
+func (consumer *Consumer) handleMessage(sess sarama.ConsumerGroupSession,
+	msg *sarama.ConsumerMessage, replay bool) error {
+	// Extract the userID from the message key
+	userID := string(msg.Key)
+	if userID == "" {
+		metrics.DecodeFailures.WithLabelValues(msg.Topic, metrics.DecodeMissingKey).Inc()
+		return consumer.forwardToDeadLetter(sess, msg, ErrMissingRecipient, replay)
+	}
+	// Messages from older producers have no headers and are always JSON
+	headers := headerValues(msg)
+	if contentType, ok := headers[models.HeaderContentType]; ok && contentType != models.ContentTypeJSON {
+		metrics.DecodeFailures.WithLabelValues(msg.Topic, metrics.DecodeContentType).Inc()
+		return consumer.forwardToDeadLetter(sess, msg,
+			fmt.Errorf("%w: %q", ErrUnsupportedContentType, contentType), replay)
+	}
+	// Create a notification object to store the message data
+	var notification models.Notification
+	// Deserialize the JSON message value into the notification struct
+	err := json.Unmarshal(msg.Value, &notification)
+	if err != nil {
+		// Poison message: move it out of the way so offsets keep advancing
+		logger.Errorf("failed to unmarshal notification: %v", err)
+		metrics.DecodeFailures.WithLabelValues(msg.Topic, metrics.DecodeJSON).Inc()
+		return consumer.forwardToDeadLetter(sess, msg,
+			fmt.Errorf("failed to unmarshal notification: %w", err), replay)
+	}
+	// Fill in the fields missing from messages produced by older producers
+	// and the trace sent in the headers
+	normalizeNotification(&notification, msg, headers)
+	correlationID := ""
+	if notification.Trace != nil {
+		correlationID = notification.Trace.CorrelationID
+	}
+	// Skip notifications already delivered to the user (redeliveries, producer retries)
+	dedupKey := DedupKey(notification)
+	if consumer.deduper.IsDuplicate(userID, dedupKey, time.Now()) {
+		logger.Warn("Skipping duplicate notification", "userID", userID, "key", dedupKey,
+			"correlationID", correlationID, "partition", msg.Partition, "offset", msg.Offset)
+		metrics.Consumed.WithLabelValues(msg.Topic, metrics.OutcomeDuplicate).Inc()
+		return consumer.markSkipped(sess, msg)
+	}
+	// Store the notification in the notification store for the user
+	stored, err := consumer.add(userID, notification, msg)
+	if err != nil {
+		// Stop the session without marking the message so it is consumed again
+		logger.Error("Failed to store notification", "id", notification.ID,
+			"correlationID", correlationID, "error", err)
+		return fmt.Errorf("failed to store notification: %w", err)
+	}
+	consumer.deduper.Remember(userID, dedupKey, time.Now())
+	if replay {
+		metrics.Consumed.WithLabelValues(msg.Topic, metrics.OutcomeReplayed).Inc()
+		logger.Info("Notification replayed", "id", notification.ID, "userID", userID,
+			"correlationID", correlationID, "partition", msg.Partition, "offset", msg.Offset)
+		return nil
+	}
+	metrics.Consumed.WithLabelValues(msg.Topic, metrics.OutcomeStored).Inc()
+	logger.Info("Notification consumed", "id", notification.ID, "userID", userID,
+		"correlationID", correlationID, "partition", msg.Partition, "offset", msg.Offset)
+	// Push the stored notification to the user's live streams
+	consumer.hub.Publish(userID, stored)
+	// Mark the message as processed, the store already recorded its offset
+	sess.MarkMessage(msg, "")
+	return nil
+}
+
+// markSkipped marks a message that was handled without storing a notification
+// Durable stores record its offset first, so it is not handled again after a restart
+func (consumer *Consumer) markSkipped(sess sarama.ConsumerGroupSession, msg *sarama.ConsumerMessage) error {
+	if checkpointer, ok := consumer.store.(store.Checkpointer); ok {
+		err := checkpointer.SetCheckpoint(store.Position{
+			Topic:     msg.Topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+		})
 		if err != nil {
-			// Log any JSON parsing errors and continue to next message
-			logger.Errorf("failed to unmarshal notification: %v", err)
-			continue
+			logger.Errorf("failed to record checkpoint %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+			return fmt.Errorf("failed to record checkpoint: %w", err)
 		}
-		// Store the notification in the notification store for the user
-		consumer.store.Add(userID, notification)
-		// Mark the message as processed
-		sess.MarkMessage(msg, "")
 	}
+	sess.MarkMessage(msg, "")
 	return nil
 }
 
+// forwardToDeadLetter publishes a message that cannot be processed to the dead-letter
+// topic and marks it as consumed. If forwarding fails the message is left unmarked
+// and the error stops the session, so it is retried instead of being lost
+// A replayed message was already forwarded by the previous owner and is only skipped
+func (consumer *Consumer) forwardToDeadLetter(sess sarama.ConsumerGroupSession,
+	msg *sarama.ConsumerMessage, cause error, replay bool) error {
+	if replay {
+		metrics.Consumed.WithLabelValues(msg.Topic, metrics.OutcomeSkipped).Inc()
+		return consumer.markSkipped(sess, msg)
+	}
+	if err := consumer.deadLetter.Forward(msg, cause); err != nil {
+		logger.Errorf("failed to dead-letter message %s/%d/%d: %v", msg.Topic, msg.Partition, msg.Offset, err)
+		return err
+	}
+	metrics.Consumed.WithLabelValues(msg.Topic, metrics.OutcomeDeadLettered).Inc()
+	return consumer.markSkipped(sess, msg)
+}
+
+// normalizeNotification fills in the fields that messages produced before they
+// were introduced lack. The ID is taken from the headers or derived from the message
+// position so it is stable across redeliveries, and the creation time falls back to
+// the Kafka timestamp. The trace is read from the headers
+func normalizeNotification(notification *models.Notification, msg *sarama.ConsumerMessage,
+	headers map[string]string) {
+	if notification.ID == "" {
+		notification.ID = headers[models.HeaderNotificationID]
+	}
+	if notification.ID == "" {
+		notification.ID = fmt.Sprintf("%s-%d-%d", msg.Topic, msg.Partition, msg.Offset)
+	}
+	notification.Trace = messageTrace(headers)
+	if notification.Kind == "" {
+		notification.Kind = models.KindMessage
+	}
+	if notification.CreatedAt.IsZero() {
+		notification.CreatedAt = msg.Timestamp
+	}
+}
+
+// headerValues returns the message headers by key
+func headerValues(msg *sarama.ConsumerMessage) map[string]string {
+	headers := make(map[string]string, len(msg.Headers))
+	for _, header := range msg.Headers {
+		if header != nil {
+			headers[string(header.Key)] = string(header.Value)
+		}
+	}
+	return headers
+}
+
+// messageTrace builds the trace of a notification from its message headers,
+// nil when the producer sent none
+func messageTrace(headers map[string]string) *models.Trace {
+	trace := models.Trace{
+		CorrelationID: headers[models.HeaderCorrelationID],
+		SchemaVersion: headers[models.HeaderSchemaVersion],
+		ProducerHost:  headers[models.HeaderProducerHost],
+	}
+	if value, ok := headers[models.HeaderProducedAt]; ok {
+		if producedAt, err := time.Parse(time.RFC3339Nano, value); err == nil {
+			trace.ProducedAt = &producedAt
+		}
+	}
+	if trace == (models.Trace{}) {
+		return nil
+	}
+	return &trace
+}
+
+// add stores a notification, recording its offset when the store keeps checkpoints
+func (consumer *Consumer) add(userID string, notification models.Notification,
+	msg *sarama.ConsumerMessage) (store.StoredNotification, error) {
+	if checkpointer, ok := consumer.store.(store.Checkpointer); ok {
+		return checkpointer.AddAt(userID, notification, store.Position{
+			Topic:     msg.Topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+		})
+	}
+	return consumer.store.Add(userID, notification)
+}
+
 // initializeConsumerGroup creates and configures a new Kafka consumer group
-// Returns the consumer group instance and any error that occurred
-func initializeConsumerGroup() (sarama.ConsumerGroup, error) {
+// advertising the HTTP address of this instance to the other members
+// Returns the client, the consumer group instance and any error that occurred
+// The client must be closed after the consumer group
+func initializeConsumerGroup(advertisedAddress string) (sarama.Client, sarama.ConsumerGroup, error) {
 	// Create default Sarama configuration
 	config := sarama.NewConfig()
 
@@ -61,41 +303,82 @@ func initializeConsumerGroup() (sarama.ConsumerGroup, error) {
 	// Enable error reporting for the consumer group
 	config.Consumer.Return.Errors = true
 	config.Consumer.Offsets.Initial = sarama.OffsetOldest
+	// Skip the messages of aborted producer transactions
+	config.Consumer.IsolationLevel = sarama.ReadCommitted
+	// Offsets are committed by the consumer once the store has persisted the messages
+	config.Consumer.Offsets.AutoCommit.Enable = false
 
 	// Disable IPv6 resolution
 	config.Net.SASL.Enable = false
 	config.Net.DialTimeout = 10 * time.Second
+	// Let the other instances route queries about our partitions to us
+	config.Consumer.Group.Member.UserData = []byte(advertisedAddress)
 
-	// Create a new consumer group with the specified address, group name and config
-	consumerGroup, err := sarama.NewConsumerGroup(
-		[]string{KafkaServerAddress}, ConsumerGroup, config)
+	// Create the client shared by the consumer group and the router
+	client, err := sarama.NewClient([]string{KafkaServerAddress}, config)
+	if err != nil {
+		logger.Errorf("failed to initialize consumer group: %v", err)
+		return nil, nil, fmt.Errorf("failed to initialize consumer group: %w", err)
+	}
+	// Create a new consumer group with the specified group name on the client
+	consumerGroup, err := sarama.NewConsumerGroupFromClient(ConsumerGroup, client)
 	if err != nil {
 		// Return error if consumer group creation fails
+		client.Close()
 		logger.Errorf("failed to initialize consumer group: %v", err)
-		return nil, fmt.Errorf("failed to initialize consumer group: %w", err)
+		return nil, nil, fmt.Errorf("failed to initialize consumer group: %w", err)
 	}
 	logger.Infof("Successfully connected to Kafka server at %s", KafkaServerAddress)
-	return consumerGroup, nil
+	return client, consumerGroup, nil
 }
 
 // setupConsumerGroup initializes and runs the consumer group processing loop
-// Takes a context for cancellation and notification store for persistence
-func setupConsumerGroup(ctx context.Context, store *NotificationStore) {
+// Takes a context for cancellation, notification store for persistence, hub for live delivery,
+// deduplicator to drop redelivered messages, the policy for committing offsets and
+// the router learning the partition owners, the hand-off state of the claimed partitions
+// and the metrics reporting the lag, throughput and rebalances
+func setupConsumerGroup(ctx context.Context, notificationStore store.Store, hub *Hub,
+	deduper *Deduplicator, commits CommitPolicy, router *Router, partitions *PartitionStates,
+	consumerMetrics *Metrics) {
 	// Initialize the consumer group
-	consumerGroup, err := initializeConsumerGroup()
+	client, consumerGroup, err := initializeConsumerGroup(router.self)
 	if err != nil {
 		// Log any initialization errors
 		logger.Fatalf("initialization error: %v", err)
 	}
-	// Ensure consumer group is closed when function returns
+	// Ensure the client is closed after the consumer group when function returns
+	defer client.Close()
 	defer consumerGroup.Close()
+	router.attach(client)
+	// Report the errors of the group, failed offset commits included
+	go func() {
+		for err := range consumerGroup.Errors() {
+			logger.Errorf("consumer group error: %v", err)
+		}
+	}()
+
+	// Initialize the producer used to dead-letter poison messages
+	deadLetter, err := dlq.NewForwarder([]string{KafkaServerAddress}, DeadLetterTopic)
+	if err != nil {
+		logger.Fatalf("initialization error: %v", err)
+	}
+	defer deadLetter.Close()
 
 	// Create consumer instance with reference to notification store
 	consumer := &Consumer{
-		store: store,
+		store:      notificationStore,
+		hub:        hub,
+		deduper:    deduper,
+		deadLetter: deadLetter,
+		commits:    commits,
+		router:     router,
+		partitions: partitions,
+		client:     client,
+		metrics:    consumerMetrics,
 	}
 	logger.Infof("Starting to consume from topic: %s", ConsumerTopic)
 	logger.Infof("Consumer group: %s", ConsumerGroup)
+	logger.Infof("Dead-letter topic: %s", DeadLetterTopic)
 
 	// Run continuous processing loop
 	for {
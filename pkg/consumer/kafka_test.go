@@ -0,0 +1,150 @@
+package consumer
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/store"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testTopic = "notifications"
+
+// testSession is a sarama.ConsumerGroupSession recording the offsets it is given
+type testSession struct {
+	ctx    context.Context
+	claims map[string][]int32
+
+	mu      sync.Mutex
+	marked  []int64         // Offsets of the messages marked, in order
+	offsets map[int32]int64 // Offsets moved with MarkOffset
+	commits int
+}
+
+func newTestSession(partitions ...int32) *testSession {
+	return &testSession{
+		ctx:     context.Background(),
+		claims:  map[string][]int32{testTopic: partitions},
+		offsets: make(map[int32]int64),
+	}
+}
+
+func (s *testSession) Claims() map[string][]int32 { return s.claims }
+func (s *testSession) MemberID() string           { return "member" }
+func (s *testSession) GenerationID() int32        { return 1 }
+func (s *testSession) Context() context.Context   { return s.ctx }
+
+func (s *testSession) MarkOffset(_ string, partition int32, offset int64, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offsets[partition] = offset
+}
+
+func (s *testSession) ResetOffset(_ string, partition int32, offset int64, _ string) {
+	s.MarkOffset(testTopic, partition, offset, "")
+}
+
+func (s *testSession) MarkMessage(msg *sarama.ConsumerMessage, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.marked = append(s.marked, msg.Offset)
+}
+
+func (s *testSession) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commits++
+}
+
+// testClaim is a sarama.ConsumerGroupClaim delivering the messages queued on it
+type testClaim struct {
+	partition     int32
+	initialOffset int64
+	messages      chan *sarama.ConsumerMessage
+}
+
+// newTestClaim returns a claim of partition 0 that delivers msgs and then ends
+func newTestClaim(msgs ...*sarama.ConsumerMessage) *testClaim {
+	claim := &testClaim{initialOffset: sarama.OffsetNewest, messages: make(chan *sarama.ConsumerMessage, len(msgs))}
+	for _, msg := range msgs {
+		claim.messages <- msg
+	}
+	close(claim.messages)
+	return claim
+}
+
+func (c *testClaim) Topic() string                            { return testTopic }
+func (c *testClaim) Partition() int32                         { return c.partition }
+func (c *testClaim) InitialOffset() int64                     { return c.initialOffset }
+func (c *testClaim) HighWaterMarkOffset() int64               { return 0 }
+func (c *testClaim) Messages() <-chan *sarama.ConsumerMessage { return c.messages }
+
+// testMessage encodes a notification for userID as a message of partition 0
+func testMessage(t *testing.T, offset int64, userID string, notification models.Notification) *sarama.ConsumerMessage {
+	value, err := json.Marshal(notification)
+	require.NoError(t, err)
+	return &sarama.ConsumerMessage{
+		Topic:     testTopic,
+		Offset:    offset,
+		Key:       []byte(userID),
+		Value:     value,
+		Timestamp: time.Now(),
+	}
+}
+
+// newTestConsumer returns a consumer writing to notificationStore with the default commit policy
+func newTestConsumer(notificationStore store.Store) *Consumer {
+	return &Consumer{
+		store:   notificationStore,
+		hub:     NewHub(),
+		deduper: NewDeduplicator(time.Hour, 100),
+		commits: CommitPolicy{Messages: 100, Interval: time.Hour},
+	}
+}
+
+func TestConsumeClaimStoresRedeliveryOnce(t *testing.T) {
+	backends := map[string]func(t *testing.T) store.Store{
+		store.BackendMemory: func(t *testing.T) store.Store { return store.NewMemoryStore() },
+		store.BackendBolt: func(t *testing.T) store.Store {
+			s, err := store.NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+			require.NoError(t, err)
+			return s
+		},
+	}
+	for name, newStore := range backends {
+		t.Run(name, func(t *testing.T) {
+			notificationStore := newStore(t)
+			t.Cleanup(func() { assert.NoError(t, notificationStore.Close()) })
+			consumer := newTestConsumer(notificationStore)
+
+			first := models.Notification{ID: "a", Message: "hello"}
+			retried := models.Notification{ID: "b", IdempotencyKey: "key", Message: "retried"}
+			sess := newTestSession(0)
+			claim := newTestClaim(
+				testMessage(t, 0, "1", first),
+				// Redelivered after a rebalance before the offset was committed
+				testMessage(t, 1, "1", first),
+				// Producer retry: a new ID but the same idempotency key
+				testMessage(t, 2, "1", retried),
+				testMessage(t, 3, "1", models.Notification{ID: "c", IdempotencyKey: "key", Message: "retried"}),
+			)
+			require.NoError(t, consumer.ConsumeClaim(sess, claim))
+
+			stored, err := notificationStore.List("1")
+			require.NoError(t, err)
+			require.Len(t, stored, 2)
+			assert.Equal(t, "a", stored[0].ID)
+			assert.Equal(t, "b", stored[1].ID)
+			// Duplicates are still marked so the offsets keep advancing
+			assert.Equal(t, []int64{0, 1, 2, 3}, sess.marked)
+		})
+	}
+}
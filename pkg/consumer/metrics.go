@@ -0,0 +1,283 @@
+package consumer
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// rateWindow is the number of seconds the messages per second are averaged over
+const rateWindow = 60
+
+// PartitionMetrics reports how far behind the consumer is on a partition
+type PartitionMetrics struct {
+	Partition       int32      `json:"partition"`
+	Claimed         bool       `json:"claimed"`
+	HighWaterMark   int64      `json:"highWaterMark"`
+	ProcessedOffset int64      `json:"processedOffset"` // Last offset processed, -1 when none yet
+	CommittedOffset int64      `json:"committedOffset"` // Next offset the group resumes from, -1 when unknown
+	Lag             int64      `json:"lag"`             // Messages not processed yet
+	CommitLag       int64      `json:"commitLag"`       // Messages redelivered if the instance crashed now
+	Processed       int64      `json:"processed"`       // Messages processed since the instance started
+	PerSecond       float64    `json:"messagesPerSecond"`
+	LastProcessedAt *time.Time `json:"lastProcessedAt,omitempty"`
+}
+
+// MetricsSnapshot is the state of the consumer at a point in time
+type MetricsSnapshot struct {
+	Topic           string             `json:"topic"`
+	Rebalances      int64              `json:"rebalances"`
+	LastRebalanceAt *time.Time         `json:"lastRebalanceAt,omitempty"`
+	Lag             int64              `json:"lag"`
+	PerSecond       float64            `json:"messagesPerSecond"`
+	Partitions      []PartitionMetrics `json:"partitions"`
+}
+
+// rateBucket counts the messages processed during one second
+type rateBucket struct {
+	second int64
+	count  int64
+}
+
+// partitionCounters holds what was observed on a partition
+type partitionCounters struct {
+	claim           sarama.ConsumerGroupClaim // nil when the partition is not claimed
+	processedOffset int64
+	committedOffset int64
+	processed       int64
+	lastProcessedAt time.Time
+	buckets         [rateWindow]rateBucket
+}
+
+// Metrics tracks the lag and throughput of the consumer on every partition it
+// consumed, and the rebalances of the group. The high-water marks are read from
+// the claims, which sarama updates with every fetch, so a scrape costs no broker call
+type Metrics struct {
+	topic string
+
+	mu              sync.Mutex
+	partitions      map[int32]*partitionCounters
+	rebalances      int64
+	lastRebalanceAt time.Time
+}
+
+// NewMetrics creates the metrics of the consumer of topic
+func NewMetrics(topic string) *Metrics {
+	return &Metrics{topic: topic, partitions: make(map[int32]*partitionCounters)}
+}
+
+// counters returns the counters of a partition, created on first use
+// Must be called with the lock held
+func (m *Metrics) counters(partition int32) *partitionCounters {
+	counters, ok := m.partitions[partition]
+	if !ok {
+		counters = &partitionCounters{processedOffset: -1, committedOffset: -1}
+		m.partitions[partition] = counters
+	}
+	return counters
+}
+
+// rebalanced counts a new session of the consumer group
+func (m *Metrics) rebalanced() {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.rebalances++
+	m.lastRebalanceAt = time.Now().UTC()
+}
+
+// claimed starts reading the high-water mark of a claim, the group resumes at its initial offset
+func (m *Metrics) claimed(claim sarama.ConsumerGroupClaim) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters := m.counters(claim.Partition())
+	counters.claim = claim
+	if claim.InitialOffset() >= 0 {
+		counters.committedOffset = claim.InitialOffset()
+	}
+}
+
+// released stops reporting the lag of the partitions of an ended session
+func (m *Metrics) released(partitions []int32) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, partition := range partitions {
+		if counters, ok := m.partitions[partition]; ok {
+			counters.claim = nil
+		}
+	}
+}
+
+// processed counts a message handled at now
+func (m *Metrics) processed(partition int32, offset int64, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	counters := m.counters(partition)
+	counters.processedOffset = offset
+	counters.processed++
+	counters.lastProcessedAt = now
+	second := now.Unix()
+	bucket := &counters.buckets[second%rateWindow]
+	if bucket.second != second {
+		*bucket = rateBucket{second: second}
+	}
+	bucket.count++
+}
+
+// committed records the next offset of a partition committed to Kafka
+func (m *Metrics) committed(partition int32, offset int64) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters(partition).committedOffset = offset
+}
+
+// Snapshot returns the metrics of every partition consumed so far, ordered by partition
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	snapshot := MetricsSnapshot{
+		Topic:      m.topic,
+		Rebalances: m.rebalances,
+		Partitions: make([]PartitionMetrics, 0, len(m.partitions)),
+	}
+	if !m.lastRebalanceAt.IsZero() {
+		lastRebalanceAt := m.lastRebalanceAt
+		snapshot.LastRebalanceAt = &lastRebalanceAt
+	}
+	for partition, counters := range m.partitions {
+		metrics := PartitionMetrics{
+			Partition:       partition,
+			Claimed:         counters.claim != nil,
+			ProcessedOffset: counters.processedOffset,
+			CommittedOffset: counters.committedOffset,
+			Processed:       counters.processed,
+			PerSecond:       counters.perSecond(now),
+		}
+		if !counters.lastProcessedAt.IsZero() {
+			lastProcessedAt := counters.lastProcessedAt.UTC()
+			metrics.LastProcessedAt = &lastProcessedAt
+		}
+		if counters.claim != nil {
+			metrics.HighWaterMark = counters.claim.HighWaterMarkOffset()
+			position := counters.committedOffset
+			if counters.processedOffset+1 > position {
+				position = counters.processedOffset + 1
+			}
+			metrics.Lag = behind(metrics.HighWaterMark, position)
+			metrics.CommitLag = behind(metrics.HighWaterMark, counters.committedOffset)
+		}
+		snapshot.Lag += metrics.Lag
+		snapshot.PerSecond += metrics.PerSecond
+		snapshot.Partitions = append(snapshot.Partitions, metrics)
+	}
+	sort.Slice(snapshot.Partitions, func(i, j int) bool {
+		return snapshot.Partitions[i].Partition < snapshot.Partitions[j].Partition
+	})
+	return snapshot
+}
+
+// perSecond averages the messages processed over the last rateWindow seconds
+func (counters *partitionCounters) perSecond(now time.Time) float64 {
+	var count int64
+	for _, bucket := range counters.buckets {
+		if now.Unix()-bucket.second < rateWindow {
+			count += bucket.count
+		}
+	}
+	return float64(count) / rateWindow
+}
+
+// behind returns how many offsets position is behind the high-water mark
+// The high-water mark is 0 until the first fetch of the claim, which reports no lag
+func behind(highWaterMark, position int64) int64 {
+	if highWaterMark <= 0 || position < 0 || position >= highWaterMark {
+		return 0
+	}
+	return highWaterMark - position
+}
+
+var (
+	partitionLabels = []string{"topic", "partition"}
+
+	lagDesc = prometheus.NewDesc("notify_consumer_partition_lag",
+		"Messages of the partition not processed yet", partitionLabels, nil)
+	commitLagDesc = prometheus.NewDesc("notify_consumer_partition_commit_lag",
+		"Messages of the partition past the committed offset", partitionLabels, nil)
+	highWaterMarkDesc = prometheus.NewDesc("notify_consumer_partition_high_water_mark",
+		"Offset of the next message produced to the partition", partitionLabels, nil)
+	processedOffsetDesc = prometheus.NewDesc("notify_consumer_partition_processed_offset",
+		"Last offset processed on the partition", partitionLabels, nil)
+	committedOffsetDesc = prometheus.NewDesc("notify_consumer_partition_committed_offset",
+		"Next offset of the partition committed to Kafka", partitionLabels, nil)
+	perSecondDesc = prometheus.NewDesc("notify_consumer_partition_messages_per_second",
+		"Messages processed per second over the last minute", partitionLabels, nil)
+	lastProcessedDesc = prometheus.NewDesc("notify_consumer_partition_last_processed_timestamp_seconds",
+		"Unix time of the last message processed on the partition", partitionLabels, nil)
+	processedDesc = prometheus.NewDesc("notify_consumer_messages_processed_total",
+		"Messages processed since the instance started", partitionLabels, nil)
+	rebalancesDesc = prometheus.NewDesc("notify_consumer_rebalances_total",
+		"Sessions of the consumer group started since the instance started", []string{"topic"}, nil)
+)
+
+// constGauge is a gauge value reported at scrape time
+type constGauge struct {
+	desc  *prometheus.Desc
+	value float64
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{lagDesc, commitLagDesc, highWaterMarkDesc, processedOffsetDesc,
+		committedOffsetDesc, perSecondDesc, lastProcessedDesc, processedDesc, rebalancesDesc} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector
+// Offsets and lag are only reported for the partitions claimed by this instance
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	snapshot := m.Snapshot()
+	ch <- prometheus.MustNewConstMetric(rebalancesDesc, prometheus.CounterValue,
+		float64(snapshot.Rebalances), snapshot.Topic)
+	for _, partition := range snapshot.Partitions {
+		labels := []string{snapshot.Topic, strconv.Itoa(int(partition.Partition))}
+		ch <- prometheus.MustNewConstMetric(processedDesc, prometheus.CounterValue,
+			float64(partition.Processed), labels...)
+		if !partition.Claimed {
+			continue
+		}
+		gauges := []constGauge{
+			{lagDesc, float64(partition.Lag)},
+			{commitLagDesc, float64(partition.CommitLag)},
+			{highWaterMarkDesc, float64(partition.HighWaterMark)},
+			{processedOffsetDesc, float64(partition.ProcessedOffset)},
+			{committedOffsetDesc, float64(partition.CommittedOffset)},
+			{perSecondDesc, partition.PerSecond},
+		}
+		if partition.LastProcessedAt != nil {
+			gauges = append(gauges, constGauge{lastProcessedDesc, float64(partition.LastProcessedAt.UnixNano()) / 1e9})
+		}
+		for _, gauge := range gauges {
+			ch <- prometheus.MustNewConstMetric(gauge.desc, prometheus.GaugeValue, gauge.value, labels...)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"sync"
+
+	"github.com/IBM/sarama"
+	"github.com/alejoacosta74/go-logger"
+	"github.com/gin-gonic/gin"
+)
+
+// Routing modes for queries about users owned by another consumer instance
+const (
+	RoutingProxy    = "proxy"    // Forward the request and relay the response
+	RoutingRedirect = "redirect" // Answer 307 Temporary Redirect to the owner
+	RoutingOff      = "off"      // Always answer from the local store
+)
+
+// ForwardedHeader marks a request routed by another instance, it is always served locally
+const ForwardedHeader = "X-Notify-Forwarded"
+
+// ErrUnknownRoutingMode is returned when the configured routing mode does not exist
+var ErrUnknownRoutingMode = errors.New("unknown routing mode")
+
+// PartitionOwner reports which instance consumes a partition
+type PartitionOwner struct {
+	Partition int32  `json:"partition"`
+	Address   string `json:"address"`
+	Local     bool   `json:"local"`
+}
+
+// Router knows which consumer instance of the group owns each partition and sends
+// the queries about a user to the instance holding the user's notifications
+// Every instance advertises its HTTP address in its group member user data; the
+// ownership map is rebuilt from the group description after each rebalance
+type Router struct {
+	self  string // Advertised HTTP address of this instance
+	mode  string
+	topic string
+
+	mu      sync.RWMutex
+	client  sarama.Client
+	owners  map[int32]string // Partition to the HTTP address of its owner
+	proxies map[string]*httputil.ReverseProxy
+}
+
+// NewRouter creates a router for the instance reachable at self
+func NewRouter(self, mode, topic string) (*Router, error) {
+	switch mode {
+	case RoutingProxy, RoutingRedirect, RoutingOff:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownRoutingMode, mode)
+	}
+	if _, err := url.Parse(self); err != nil {
+		return nil, fmt.Errorf("invalid advertised address %q: %w", self, err)
+	}
+	return &Router{self: self, mode: mode, topic: topic, proxies: make(map[string]*httputil.ReverseProxy)}, nil
+}
+
+// attach gives the router the client used to look up partitions and the group members
+func (r *Router) attach(client sarama.Client) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.client = client
+}
+
+// assign rebuilds the ownership map when a session starts
+// The local claims are always known; the other members' are read from the group
+// description, and when that fails queries are answered locally until the next rebalance
+func (r *Router) assign(sess sarama.ConsumerGroupSession, group string) {
+	if r == nil {
+		return
+	}
+	owners := make(map[int32]string)
+	r.mu.RLock()
+	client := r.client
+	r.mu.RUnlock()
+	if client != nil {
+		members, err := describeMembers(client, group, r.topic)
+		if err != nil {
+			logger.Warn("Failed to describe consumer group, queries are answered locally", "error", err)
+		}
+		for partition, address := range members {
+			owners[partition] = address
+		}
+	}
+	for _, partition := range sess.Claims()[r.topic] {
+		owners[partition] = r.self
+	}
+
+	r.mu.Lock()
+	r.owners = owners
+	r.mu.Unlock()
+	logger.Info("Partition ownership updated", "partitions", len(owners), "local", len(sess.Claims()[r.topic]))
+}
+
+// revoke forgets the ownership map when a session ends, it is stale during a rebalance
+func (r *Router) revoke() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.owners = nil
+}
+
+// owner returns the HTTP address of the instance owning the user's partition
+// Returns false when the owner is unknown
+func (r *Router) owner(userID string) (string, bool) {
+	r.mu.RLock()
+	client, owners := r.client, r.owners
+	r.mu.RUnlock()
+	if client == nil || owners == nil {
+		return "", false
+	}
+	partitions, err := client.Partitions(r.topic)
+	if err != nil || len(partitions) == 0 {
+		return "", false
+	}
+	// The producer keys messages by recipient ID with the default hash partitioner
+	partition, err := sarama.NewHashPartitioner(r.topic).Partition(
+		&sarama.ProducerMessage{Key: sarama.StringEncoder(userID)}, int32(len(partitions)))
+	if err != nil {
+		return "", false
+	}
+	address, ok := owners[partition]
+	return address, ok
+}
+
+// Owners returns the known owner of every partition, ordered by partition
+func (r *Router) Owners() []PartitionOwner {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	owners := make([]PartitionOwner, 0, len(r.owners))
+	for partition, address := range r.owners {
+		owners = append(owners, PartitionOwner{Partition: partition, Address: address, Local: address == r.self})
+	}
+	sort.Slice(owners, func(i, j int) bool { return owners[i].Partition < owners[j].Partition })
+	return owners
+}
+
+// Route creates a Gin middleware sending the requests about a user to the instance
+// owning the user's partition. Requests are served locally when this instance owns
+// the partition, when the owner is unknown or when they were already routed once
+func (r *Router) Route() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if r.mode == RoutingOff || ctx.GetHeader(ForwardedHeader) != "" {
+			ctx.Next()
+			return
+		}
+		address, ok := r.owner(ctx.Param("userID"))
+		if !ok || address == r.self || address == "" {
+			ctx.Next()
+			return
+		}
+
+		if r.mode == RoutingRedirect {
+			ctx.Redirect(http.StatusTemporaryRedirect, address+ctx.Request.URL.RequestURI())
+			ctx.Abort()
+			return
+		}
+		proxy, err := r.proxy(address)
+		if err != nil {
+			logger.Error("Invalid owner address, serving locally", "address", address, "error", err)
+			ctx.Next()
+			return
+		}
+		ctx.Request.Header.Set(ForwardedHeader, r.self)
+		proxy.ServeHTTP(ctx.Writer, ctx.Request)
+		ctx.Abort()
+	}
+}
+
+// proxy returns the reverse proxy to an instance, created on first use
+func (r *Router) proxy(address string) (*httputil.ReverseProxy, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if proxy, ok := r.proxies[address]; ok {
+		return proxy, nil
+	}
+	target, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		logger.Error("Failed to reach owner instance", "address", address, "error", err)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		fmt.Fprintf(w, `{"message":"owner instance %s is unavailable"}`, address)
+	}
+	r.proxies[address] = proxy
+	return proxy, nil
+}
+
+// describeMembers returns the HTTP address advertised by the owner of each partition of topic
+func describeMembers(client sarama.Client, group, topic string) (map[int32]string, error) {
+	admin, err := sarama.NewClusterAdminFromClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cluster admin: %w", err)
+	}
+	// Closing the admin would close the shared client
+	groups, err := admin.DescribeConsumerGroups([]string{group})
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe group %s: %w", group, err)
+	}
+	owners := make(map[int32]string)
+	for _, description := range groups {
+		if description.Err != sarama.ErrNoError {
+			return nil, fmt.Errorf("failed to describe group %s: %w", group, description.Err)
+		}
+		for memberID, member := range description.Members {
+			metadata, err := member.GetMemberMetadata()
+			if err != nil || metadata == nil || len(metadata.UserData) == 0 {
+				logger.Warn("Consumer group member advertises no address", "member", memberID)
+				continue
+			}
+			assignment, err := member.GetMemberAssignment()
+			if err != nil || assignment == nil {
+				continue
+			}
+			for _, partition := range assignment.Topics[topic] {
+				owners[partition] = string(metadata.UserData)
+			}
+		}
+	}
+	return owners, nil
+}
@@ -0,0 +1,115 @@
+package consumer
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/store"
+
+	"github.com/IBM/sarama"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestRouter returns a router for which every partition of the topic is owned by owner
+func newTestRouter(t *testing.T, mode, owner string) *Router {
+	broker := sarama.NewMockBroker(t, 1)
+	t.Cleanup(broker.Close)
+	metadata := sarama.NewMockMetadataResponse(t).SetBroker(broker.Addr(), broker.BrokerID())
+	owners := make(map[int32]string)
+	for partition := int32(0); partition < 4; partition++ {
+		metadata.SetLeader(testTopic, partition, broker.BrokerID())
+		owners[partition] = owner
+	}
+	broker.SetHandlerByMap(map[string]sarama.MockResponse{"MetadataRequest": metadata})
+	client, err := sarama.NewClient([]string{broker.Addr()}, sarama.NewConfig())
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	router, err := NewRouter("http://self:8081", mode, testTopic)
+	require.NoError(t, err)
+	router.attach(client)
+	router.owners = owners
+	return router
+}
+
+// readSSEData sends the data of every event of an SSE stream until it ends
+func readSSEData(stream io.Reader, received chan<- string) {
+	defer close(received)
+	events := bufio.NewScanner(stream)
+	for events.Scan() {
+		if data, ok := strings.CutPrefix(events.Text(), "data: "); ok {
+			received <- data
+		}
+	}
+}
+
+func TestRouteProxiesLiveStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	notificationStore := store.NewMemoryStore()
+	hub := NewHub()
+	done := make(chan struct{})
+	defer close(done)
+	owner := gin.New()
+	owner.GET("/notifications/:userID/stream", func(ctx *gin.Context) {
+		handleNotificationStream(ctx, notificationStore, hub, done)
+	})
+	ownerServer := httptest.NewServer(owner)
+	defer ownerServer.Close()
+
+	router := newTestRouter(t, RoutingProxy, ownerServer.URL)
+	local := gin.New()
+	local.GET("/notifications/:userID/stream", router.Route(), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "served locally")
+	})
+	localServer := httptest.NewServer(local)
+	defer localServer.Close()
+
+	_, err := notificationStore.Add("1", models.Notification{ID: "stored"})
+	require.NoError(t, err)
+	resp, err := http.Get(localServer.URL + "/notifications/1/stream")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	received := make(chan string, 2)
+	go readSSEData(resp.Body, received)
+	select {
+	case data := <-received:
+		assert.Contains(t, data, `"id":"stored"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("replayed notification not proxied")
+	}
+
+	// The owner is subscribed once it replayed, live notifications are flushed through the proxy
+	live, err := notificationStore.Add("1", models.Notification{ID: "live"})
+	require.NoError(t, err)
+	hub.Publish("1", live)
+	select {
+	case data := <-received:
+		assert.Contains(t, data, `"id":"live"`)
+	case <-time.After(5 * time.Second):
+		t.Fatal("live notification not flushed through the proxy")
+	}
+}
+
+func TestRouteRedirectsStream(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := newTestRouter(t, RoutingRedirect, "http://owner:8081")
+	local := gin.New()
+	local.GET("/notifications/:userID/stream", router.Route(), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, "served locally")
+	})
+
+	w := httptest.NewRecorder()
+	local.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/notifications/1/stream?lastEventId=3", nil))
+	assert.Equal(t, http.StatusTemporaryRedirect, w.Code)
+	assert.Equal(t, "http://owner:8081/notifications/1/stream?lastEventId=3", w.Header().Get("Location"))
+}
@@ -1,16 +1,26 @@
 package consumer
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/store"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/alejoacosta74/go-logger"
 	"github.com/gin-gonic/gin"
 )
 
+// HeartbeatInterval is how often an SSE comment is sent to keep idle streams open
+const HeartbeatInterval = 15 * time.Second
+
 // handleNotifications processes HTTP requests for retrieving user notifications
 // It takes a gin context and notification store as parameters
-func handleNotifications(ctx *gin.Context, store *NotificationStore) {
+func handleNotifications(ctx *gin.Context, notificationStore store.Store) {
 	// Extract the userID from the request parameters and handle any errors
 	userID, err := getUserIDFromRequest(ctx)
 	if err != nil {
@@ -19,20 +29,169 @@ func handleNotifications(ctx *gin.Context, store *NotificationStore) {
 		return
 	}
 
-	// Retrieve notifications for the user from the store
-	notes := store.Get(userID)
-	if len(notes) == 0 {
+	// Parse pagination, sort order and filters from the query string
+	query, err := getQueryFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Retrieve notifications for the user from the store, skipping the pages already seen
+	var notes []store.StoredNotification
+	if query.After > 0 {
+		notes, err = notificationStore.Since(userID, query.After)
+	} else {
+		notes, err = notificationStore.List(userID)
+	}
+	if err != nil {
+		logger.Error("Failed to list notifications", "userID", userID, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	page := store.Apply(notes, query)
+	if len(page.Notifications) == 0 {
 		// If no notifications exist, return 200 OK with empty array
 		ctx.JSON(http.StatusOK,
 			gin.H{
 				"message":       "No notifications found for user",
-				"notifications": []models.Notification{},
+				"notifications": []store.StoredNotification{},
 			})
 		return
 	}
 
-	// Return 200 OK with the array of notifications
-	ctx.JSON(http.StatusOK, gin.H{"notifications": notes})
+	// Return 200 OK with the page of notifications and the cursor of the next one
+	ctx.JSON(http.StatusOK, page)
+}
+
+// MaxPageLimit is the largest page size a client can request
+const MaxPageLimit = 500
+
+// getQueryFromRequest parses the notifications query string:
+// limit, before/after (cursors), order (asc or desc), from (sender ID), kind,
+// since/until (RFC 3339 times) and unread (true to list only unread notifications)
+func getQueryFromRequest(ctx *gin.Context) (store.Query, error) {
+	var (
+		query store.Query
+		err   error
+	)
+
+	if value := ctx.Query("limit"); value != "" {
+		query.Limit, err = strconv.Atoi(value)
+		if err != nil || query.Limit <= 0 || query.Limit > MaxPageLimit {
+			return query, fmt.Errorf("invalid limit %q, must be between 1 and %d", value, MaxPageLimit)
+		}
+	}
+	if value := ctx.Query("after"); value != "" {
+		if query.After, err = store.DecodeCursor(value); err != nil {
+			return query, err
+		}
+	}
+	if value := ctx.Query("before"); value != "" {
+		if query.Before, err = store.DecodeCursor(value); err != nil {
+			return query, err
+		}
+	}
+
+	switch query.Order = ctx.DefaultQuery("order", store.OrderAsc); query.Order {
+	case store.OrderAsc, store.OrderDesc:
+	default:
+		return query, fmt.Errorf("invalid order %q, must be %s or %s", query.Order, store.OrderAsc, store.OrderDesc)
+	}
+
+	if value := ctx.Query("from"); value != "" {
+		if query.FromID, err = strconv.Atoi(value); err != nil {
+			return query, fmt.Errorf("invalid sender ID %q", value)
+		}
+	}
+	if value := ctx.Query("kind"); value != "" {
+		if query.Kind, err = models.ParseKind(value); err != nil {
+			return query, err
+		}
+	}
+	if value := ctx.Query("since"); value != "" {
+		if query.Since, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("invalid since time %q, must be RFC 3339", value)
+		}
+	}
+	if value := ctx.Query("until"); value != "" {
+		if query.Until, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("invalid until time %q, must be RFC 3339", value)
+		}
+	}
+	if value := ctx.Query("unread"); value != "" {
+		if query.UnreadOnly, err = strconv.ParseBool(value); err != nil {
+			return query, fmt.Errorf("invalid unread filter %q", value)
+		}
+	}
+	return query, nil
+}
+
+// markReadRequest is the body of a mark-as-read request
+// Either Seqs lists the notifications to mark, or UpTo marks every notification up to it
+type markReadRequest struct {
+	Seqs []int `json:"seqs"`
+	UpTo int   `json:"upTo"`
+}
+
+// ErrInvalidMarkReadRequest is returned when a mark-as-read request selects no notifications
+var ErrInvalidMarkReadRequest = errors.New("either seqs or upTo must be provided")
+
+// handleMarkRead marks a user's notifications as read, by sequence number list
+// or by an "all up to" cursor, and returns the remaining unread count
+func handleMarkRead(ctx *gin.Context, notificationStore store.Store) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	var req markReadRequest
+	if err := ctx.ShouldBindJSON(&req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+	if len(req.Seqs) == 0 && req.UpTo <= 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": ErrInvalidMarkReadRequest.Error()})
+		return
+	}
+
+	var marked int
+	if len(req.Seqs) > 0 {
+		marked, err = notificationStore.MarkRead(userID, req.Seqs...)
+	} else {
+		marked, err = notificationStore.MarkReadUpTo(userID, req.UpTo)
+	}
+	if err != nil {
+		logger.Error("Failed to mark notifications as read", "userID", userID, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	unread, err := notificationStore.UnreadCount(userID)
+	if err != nil {
+		logger.Error("Failed to count unread notifications", "userID", userID, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"marked": marked, "unread": unread})
+}
+
+// handleUnreadCount returns how many of a user's notifications are unread
+func handleUnreadCount(ctx *gin.Context, notificationStore store.Store) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	unread, err := notificationStore.UnreadCount(userID)
+	if err != nil {
+		logger.Error("Failed to count unread notifications", "userID", userID, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"unread": unread})
 }
 
 // ErrNoMessagesFound is returned when no messages are found for a user
@@ -50,3 +209,140 @@ func getUserIDFromRequest(ctx *gin.Context) (string, error) {
 	// Return the valid userID
 	return userID, nil
 }
+
+// handleNotificationStream streams a user's notifications as Server-Sent Events
+// Missed notifications are replayed first when the client sends Last-Event-ID,
+// then new ones are pushed as soon as they are stored. The stream ends when the
+// client disconnects, falls too far behind, or the server shuts down (done is closed)
+func handleNotificationStream(ctx *gin.Context, notificationStore store.Store, hub *Hub,
+	done <-chan struct{}) {
+	userID, err := getUserIDFromRequest(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+
+	lastSeq, err := getLastEventID(ctx)
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		return
+	}
+
+	// Subscribe before replaying so nothing stored in between is lost
+	sub := hub.Subscribe(userID)
+	defer sub.Close()
+
+	// Load the notifications the client has not seen yet
+	missed, err := notificationStore.Since(userID, lastSeq)
+	if err != nil {
+		logger.Error("Failed to load missed notifications", "userID", userID, "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+		return
+	}
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("Connection", "keep-alive")
+	ctx.Header("X-Accel-Buffering", "no") // Disable response buffering in nginx proxies
+	ctx.Status(http.StatusOK)
+
+	// Replay the notifications the client has not seen yet
+	for _, notification := range missed {
+		lastSeq = notification.Seq
+		if err := writeSSEvent(ctx.Writer, notification); err != nil {
+			logger.Error("Failed to replay notification", "userID", userID, "error", err)
+			return
+		}
+	}
+	ctx.Writer.Flush()
+
+	heartbeat := time.NewTicker(HeartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			// Client went away
+			return
+		case <-done:
+			// Server is shutting down
+			return
+		case notification, ok := <-sub.C:
+			if !ok {
+				// Client fell behind, it will reconnect with Last-Event-ID
+				logger.Warn("Closing slow notification stream", "userID", userID)
+				return
+			}
+			if notification.Seq <= lastSeq {
+				// Already sent during replay
+				continue
+			}
+			lastSeq = notification.Seq
+			if err := writeSSEvent(ctx.Writer, notification); err != nil {
+				logger.Error("Failed to stream notification", "userID", userID, "error", err)
+				return
+			}
+			ctx.Writer.Flush()
+		case <-heartbeat.C:
+			if _, err := io.WriteString(ctx.Writer, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+		}
+	}
+}
+
+// getLastEventID reads the sequence number the client resumes from
+// Browsers send the Last-Event-ID header on reconnect; the lastEventId query
+// parameter is accepted for clients that cannot set headers
+func getLastEventID(ctx *gin.Context) (int, error) {
+	value := ctx.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = ctx.Query("lastEventId")
+	}
+	if value == "" {
+		return 0, nil
+	}
+	seq, err := strconv.Atoi(value)
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("invalid Last-Event-ID %q", value)
+	}
+	return seq, nil
+}
+
+// writeSSEvent writes a single notification event in the text/event-stream format
+// The sequence number is used as event ID so clients can resume from it
+func writeSSEvent(w io.Writer, notification store.StoredNotification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: notification\ndata: %s\n\n", notification.Seq, data)
+	return err
+}
+
+// handlePartitionOwners reports which instance owns each partition of the topic
+// and the hand-off state of the partitions claimed by this instance
+func handlePartitionOwners(ctx *gin.Context, router *Router, partitions *PartitionStates) {
+	ctx.JSON(http.StatusOK, gin.H{
+		"self":       router.self,
+		"routing":    router.mode,
+		"partitions": router.Owners(),
+		"claimed":    partitions.States(),
+		"warming":    partitions.Warming(),
+	})
+}
+
+// handleConsumerMetrics reports the lag and throughput of every partition and the rebalances
+func handleConsumerMetrics(ctx *gin.Context, metrics *Metrics) {
+	ctx.JSON(http.StatusOK, metrics.Snapshot())
+}
+
+// handleRetentionStats reports the retention policy and the evictions done so far
+func handleRetentionStats(ctx *gin.Context, janitor *store.Janitor) {
+	if janitor == nil {
+		ctx.JSON(http.StatusOK, gin.H{"enabled": false})
+		return
+	}
+	ctx.JSON(http.StatusOK, gin.H{"enabled": true, "stats": janitor.Stats()})
+}
@@ -0,0 +1,406 @@
+package consumer
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"kafka-notify/pkg/store"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// wsWriteWait is the time allowed to write a single message to the client
+	wsWriteWait = 10 * time.Second
+	// wsPongWait is the time allowed to read the next pong from the client
+	wsPongWait = 60 * time.Second
+	// wsPingPeriod is how often pings are sent, must be less than wsPongWait
+	wsPingPeriod = (wsPongWait * 9) / 10
+	// wsMaxMessageSize is the largest message accepted from the client
+	wsMaxMessageSize = 4096
+	// wsSendBuffer bounds the messages queued for a single connection
+	wsSendBuffer = 256
+	// wsMaxUnacked is how many notifications per user may be in flight without an ack
+	wsMaxUnacked = 128
+)
+
+// Client message types accepted on the WebSocket
+const (
+	wsTypeSubscribe   = "subscribe"
+	wsTypeUnsubscribe = "unsubscribe"
+	wsTypeAck         = "ack"
+)
+
+// Server message types sent on the WebSocket
+const (
+	wsTypeNotification = "notification"
+	wsTypeSubscribed   = "subscribed"
+	wsTypeUnsubscribed = "unsubscribed"
+	wsTypeError        = "error"
+)
+
+// ErrSlowConsumer is returned when a WebSocket client cannot keep up with its notifications
+var ErrSlowConsumer = errors.New("slow consumer")
+
+// ErrUnauthorized is returned when a WebSocket client does not present a valid token
+var ErrUnauthorized = errors.New("unauthorized")
+
+// wsClientMessage is a message sent by the client
+// Since maps user IDs to the last sequence number the client has already seen
+type wsClientMessage struct {
+	Type    string         `json:"type"`
+	UserIDs []string       `json:"userIDs,omitempty"`
+	Since   map[string]int `json:"since,omitempty"`
+	UserID  string         `json:"userID,omitempty"`
+	Seq     int            `json:"seq,omitempty"`
+}
+
+// wsServerMessage is a message sent to the client
+type wsServerMessage struct {
+	Type         string                    `json:"type"`
+	UserID       string                    `json:"userID,omitempty"`
+	UserIDs      []string                  `json:"userIDs,omitempty"`
+	Seq          int                       `json:"seq,omitempty"`
+	Notification *store.StoredNotification `json:"notification,omitempty"`
+	Message      string                    `json:"message,omitempty"`
+}
+
+// wsUserState tracks the delivery progress of one subscribed user on a connection
+type wsUserState struct {
+	sub       *Subscription
+	lastSent  int
+	lastAcked int
+	acked     chan struct{} // Signalled when an ack or unsubscribe may unblock the replay
+}
+
+// wsConnection is a single WebSocket client subscribed to one or more users
+type wsConnection struct {
+	conn  *websocket.Conn
+	store store.Store
+	hub   *Hub
+
+	send      chan wsServerMessage // Bounded queue drained by the write loop
+	closing   chan struct{}        // Closed when the connection must be torn down
+	closeOnce sync.Once
+	closeErr  error
+
+	mu    sync.Mutex
+	users map[string]*wsUserState
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// handleWebSocket upgrades the request to a WebSocket and serves notifications
+// for the users the client subscribes to until it disconnects or done is closed
+func handleWebSocket(ctx *gin.Context, notificationStore store.Store, hub *Hub,
+	authToken string, done <-chan struct{}) {
+	if err := authenticateWebSocket(ctx, authToken); err != nil {
+		ctx.JSON(http.StatusUnauthorized, gin.H{"message": err.Error()})
+		return
+	}
+
+	conn, err := wsUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// Upgrade already replied to the client with an HTTP error
+		logger.Error("Failed to upgrade WebSocket connection", "error", err)
+		return
+	}
+
+	wsConn := &wsConnection{
+		conn:    conn,
+		store:   notificationStore,
+		hub:     hub,
+		send:    make(chan wsServerMessage, wsSendBuffer),
+		closing: make(chan struct{}),
+		users:   make(map[string]*wsUserState),
+	}
+	go wsConn.writeLoop(done)
+	wsConn.readLoop()
+}
+
+// authenticateWebSocket checks the bearer token from the Authorization header
+// The token query parameter is only meant for browsers, which cannot set headers on
+// WebSockets: it ends up in access logs and proxy logs, so other clients use the header
+// The token is shared by every client: it keeps unknown clients out but does not
+// restrict which users a client may subscribe to. Authentication is disabled when
+// no token is configured
+func authenticateWebSocket(ctx *gin.Context, authToken string) error {
+	if authToken == "" {
+		return nil
+	}
+	token := strings.TrimPrefix(ctx.GetHeader("Authorization"), "Bearer ")
+	if token == "" {
+		token = ctx.Query("token")
+	}
+	if subtle.ConstantTimeCompare([]byte(token), []byte(authToken)) != 1 {
+		return ErrUnauthorized
+	}
+	return nil
+}
+
+// readLoop processes client messages until the connection fails
+// It owns the lifetime of the connection and releases all subscriptions on exit
+func (c *wsConnection) readLoop() {
+	defer c.unsubscribeAll()
+	defer c.close(nil)
+
+	c.conn.SetReadLimit(wsMaxMessageSize)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var msg wsClientMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err,
+				websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				logger.Error("WebSocket read failed", "error", err)
+			}
+			return
+		}
+
+		switch msg.Type {
+		case wsTypeSubscribe:
+			for _, userID := range msg.UserIDs {
+				c.subscribe(userID, msg.Since[userID])
+			}
+			c.enqueue(wsServerMessage{Type: wsTypeSubscribed, UserIDs: msg.UserIDs})
+		case wsTypeUnsubscribe:
+			for _, userID := range msg.UserIDs {
+				c.unsubscribe(userID)
+			}
+			c.enqueue(wsServerMessage{Type: wsTypeUnsubscribed, UserIDs: msg.UserIDs})
+		case wsTypeAck:
+			c.ack(msg.UserID, msg.Seq)
+		default:
+			c.enqueue(wsServerMessage{Type: wsTypeError, Message: "unknown message type: " + msg.Type})
+		}
+	}
+}
+
+// writeLoop is the only goroutine writing to the connection
+// It sends queued messages and keepalive pings, and closes the socket on teardown
+func (c *wsConnection) writeLoop(done <-chan struct{}) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	defer c.conn.Close()
+
+	for {
+		select {
+		case msg := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				c.close(err)
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.close(err)
+				return
+			}
+		case <-done:
+			// Server is shutting down
+			c.writeClose(websocket.CloseGoingAway, "server shutting down")
+			c.close(nil)
+			return
+		case <-c.closing:
+			if errors.Is(c.closeErr, ErrSlowConsumer) {
+				c.writeClose(websocket.ClosePolicyViolation, c.closeErr.Error())
+			} else {
+				c.writeClose(websocket.CloseNormalClosure, "")
+			}
+			return
+		}
+	}
+}
+
+// writeClose sends a close frame to the client
+func (c *wsConnection) writeClose(code int, text string) {
+	c.conn.WriteControl(websocket.CloseMessage,
+		websocket.FormatCloseMessage(code, text), time.Now().Add(wsWriteWait))
+}
+
+// close tears the connection down once, recording why
+func (c *wsConnection) close(err error) {
+	c.closeOnce.Do(func() {
+		c.closeErr = err
+		close(c.closing)
+		// Unblock the read loop so the subscriptions are released
+		c.conn.SetReadDeadline(time.Now())
+	})
+}
+
+// enqueue queues a message for the write loop without blocking
+// A full queue means the client is too slow and the connection is closed
+func (c *wsConnection) enqueue(msg wsServerMessage) bool {
+	select {
+	case c.send <- msg:
+		return true
+	case <-c.closing:
+		return false
+	default:
+		logger.Warn("Closing slow WebSocket client", "queued", len(c.send))
+		c.close(ErrSlowConsumer)
+		return false
+	}
+}
+
+// subscribe starts delivering the user's notifications stored after since
+// Subscribing again to the same user on the same connection is a no-op
+func (c *wsConnection) subscribe(userID string, since int) {
+	c.mu.Lock()
+	if _, ok := c.users[userID]; ok {
+		c.mu.Unlock()
+		return
+	}
+	state := &wsUserState{
+		sub:       c.hub.Subscribe(userID),
+		lastSent:  since,
+		lastAcked: since,
+		acked:     make(chan struct{}, 1),
+	}
+	c.users[userID] = state
+	c.mu.Unlock()
+
+	go c.forward(userID, state)
+}
+
+// forward replays missed notifications for a user and then relays live ones
+func (c *wsConnection) forward(userID string, state *wsUserState) {
+	c.mu.Lock()
+	since := state.lastSent
+	c.mu.Unlock()
+
+	missed, err := c.store.Since(userID, since)
+	if err != nil {
+		logger.Error("Failed to load missed notifications", "userID", userID, "error", err)
+		c.enqueue(wsServerMessage{Type: wsTypeError, UserID: userID, Message: err.Error()})
+		c.unsubscribe(userID)
+		return
+	}
+	for _, notification := range missed {
+		if !c.deliver(userID, state, notification, true) {
+			return
+		}
+	}
+
+	for notification := range state.sub.C {
+		if !c.deliver(userID, state, notification, false) {
+			return
+		}
+	}
+
+	// The channel was closed: either the client unsubscribed or the hub dropped us
+	c.mu.Lock()
+	current := c.users[userID]
+	c.mu.Unlock()
+	if current == state {
+		c.close(ErrSlowConsumer)
+	}
+}
+
+// deliver sends one notification unless it was already sent or the client is too far behind
+// A replay waits for the client to ack when too many notifications are in flight, a live
+// notification closes the connection instead
+func (c *wsConnection) deliver(userID string, state *wsUserState,
+	notification store.StoredNotification, replay bool) bool {
+	c.mu.Lock()
+	for {
+		if c.users[userID] != state {
+			// Unsubscribed while waiting for an ack
+			c.mu.Unlock()
+			return false
+		}
+		if notification.Seq <= state.lastSent {
+			c.mu.Unlock()
+			return true
+		}
+		if state.lastSent == state.lastAcked {
+			// Nothing is in flight: the sequence numbers before this one were pruned or
+			// seen before subscribing, they are not waiting for an ack
+			state.lastAcked = notification.Seq - 1
+		}
+		if state.lastSent-state.lastAcked < wsMaxUnacked {
+			break
+		}
+		c.mu.Unlock()
+		if !replay {
+			logger.Warn("Closing WebSocket client with too many unacked notifications", "userID", userID)
+			c.close(ErrSlowConsumer)
+			return false
+		}
+		select {
+		case <-state.acked:
+		case <-c.closing:
+			return false
+		case <-time.After(wsPongWait):
+			logger.Warn("Closing WebSocket client with too many unacked notifications", "userID", userID)
+			c.close(ErrSlowConsumer)
+			return false
+		}
+		c.mu.Lock()
+	}
+	state.lastSent = notification.Seq
+	c.mu.Unlock()
+
+	return c.enqueue(wsServerMessage{
+		Type:         wsTypeNotification,
+		UserID:       userID,
+		Seq:          notification.Seq,
+		Notification: &notification,
+	})
+}
+
+// ack records that the client processed the user's notifications up to seq
+func (c *wsConnection) ack(userID string, seq int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	state, ok := c.users[userID]
+	if !ok || seq <= state.lastAcked || seq > state.lastSent {
+		return
+	}
+	state.lastAcked = seq
+	state.wake()
+}
+
+// wake unblocks a replay waiting for an ack without blocking the caller
+func (state *wsUserState) wake() {
+	select {
+	case state.acked <- struct{}{}:
+	default:
+	}
+}
+
+// unsubscribe stops delivering the user's notifications on this connection
+func (c *wsConnection) unsubscribe(userID string) {
+	c.mu.Lock()
+	state, ok := c.users[userID]
+	delete(c.users, userID)
+	c.mu.Unlock()
+	if ok {
+		state.sub.Close()
+		state.wake()
+	}
+}
+
+// unsubscribeAll releases every subscription held by the connection
+func (c *wsConnection) unsubscribeAll() {
+	c.mu.Lock()
+	users := c.users
+	c.users = make(map[string]*wsUserState)
+	c.mu.Unlock()
+	for _, state := range users {
+		state.sub.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package consumer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/store"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// dialWebSocket serves handleWebSocket on a test server and connects to it
+func dialWebSocket(t *testing.T, notificationStore store.Store, authToken, query string) (*websocket.Conn, error) {
+	gin.SetMode(gin.TestMode)
+	done := make(chan struct{})
+	router := gin.New()
+	router.GET("/ws", func(ctx *gin.Context) {
+		handleWebSocket(ctx, notificationStore, NewHub(), authToken, done)
+	})
+	server := httptest.NewServer(router)
+	t.Cleanup(func() {
+		close(done)
+		server.Close()
+	})
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err == nil {
+		t.Cleanup(func() { conn.Close() })
+	}
+	return conn, err
+}
+
+func TestWebSocketReplaysMoreThanTheUnackedWindow(t *testing.T) {
+	notificationStore := store.NewMemoryStore()
+	total := 2*wsMaxUnacked + 10
+	for i := 0; i < total; i++ {
+		_, err := notificationStore.Add("1", models.Notification{Message: "hello"})
+		require.NoError(t, err)
+	}
+	// Seqs pruned by retention must not count as unacked
+	for seq := 1; seq <= 20; seq++ {
+		require.NoError(t, notificationStore.Delete("1", seq))
+	}
+
+	conn, err := dialWebSocket(t, notificationStore, "", "")
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(wsClientMessage{Type: wsTypeSubscribe, UserIDs: []string{"1"}}))
+
+	received := 0
+	for received < total-20 {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var msg wsServerMessage
+		require.NoError(t, conn.ReadJSON(&msg), "after %d notifications", received)
+		if msg.Type != wsTypeNotification {
+			continue
+		}
+		assert.Equal(t, 21+received, msg.Seq)
+		received++
+		require.NoError(t, conn.WriteJSON(wsClientMessage{Type: wsTypeAck, UserID: "1", Seq: msg.Seq}))
+	}
+}
+
+func TestWebSocketWindowCountsInFlightNotifications(t *testing.T) {
+	notificationStore := store.NewMemoryStore()
+	for i := 0; i < wsMaxUnacked+1; i++ {
+		_, err := notificationStore.Add("1", models.Notification{Message: "hello"})
+		require.NoError(t, err)
+	}
+
+	conn, err := dialWebSocket(t, notificationStore, "", "")
+	require.NoError(t, err)
+	require.NoError(t, conn.WriteJSON(wsClientMessage{Type: wsTypeSubscribe, UserIDs: []string{"1"}}))
+
+	// Without acks the replay stops once the window is full
+	received := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		var msg wsServerMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			break
+		}
+		if msg.Type == wsTypeNotification {
+			received++
+		}
+	}
+	assert.Equal(t, wsMaxUnacked, received)
+}
+
+func TestWebSocketAuthentication(t *testing.T) {
+	notificationStore := store.NewMemoryStore()
+
+	_, err := dialWebSocket(t, notificationStore, "secret", "")
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	_, err = dialWebSocket(t, notificationStore, "secret", "?token=wrong")
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	_, err = dialWebSocket(t, notificationStore, "secret", "?token=secret")
+	assert.NoError(t, err)
+}
+
+func TestWebSocketAuthenticationPrefersHeader(t *testing.T) {
+	authenticate := func(header, query string) error {
+		ctx, _ := gin.CreateTestContext(httptest.NewRecorder())
+		ctx.Request = httptest.NewRequest(http.MethodGet, "/ws"+query, nil)
+		if header != "" {
+			ctx.Request.Header.Set("Authorization", "Bearer "+header)
+		}
+		return authenticateWebSocket(ctx, "secret")
+	}
+
+	assert.NoError(t, authenticate("secret", ""))
+	assert.ErrorIs(t, authenticate("wrong", ""), ErrUnauthorized)
+	// The query is only read when no header was sent
+	assert.ErrorIs(t, authenticate("wrong", "?token=secret"), ErrUnauthorized)
+	assert.NoError(t, authenticate("", "?token=secret"))
+}
@@ -0,0 +1,100 @@
+package directory
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"kafka-notify/pkg/models"
+)
+
+// Supported directory backends
+const (
+	BackendStatic = "static"
+	BackendFile   = "file"
+	BackendSQLite = "sqlite"
+	BackendHTTP   = "http"
+)
+
+var (
+	// ErrUserNotFound is returned when a user does not exist in the directory
+	ErrUserNotFound = errors.New("user not found")
+	// ErrGroupNotFound is returned when a group does not exist in the directory
+	ErrGroupNotFound = errors.New("group not found")
+	// ErrUnknownBackend is returned when the configured directory backend is not supported
+	ErrUnknownBackend = errors.New("unknown user directory backend")
+	// ErrUserExists is returned when creating a user with an ID that is already taken
+	ErrUserExists = errors.New("user already exists")
+	// ErrInvalidUser is returned when a created or updated user fails validation
+	ErrInvalidUser = errors.New("invalid user")
+	// ErrReadOnly is returned when editing a directory that does not implement Editor
+	ErrReadOnly = errors.New("user directory is read-only")
+)
+
+// MaxNameLength is the longest user name accepted by the editable directories
+const MaxNameLength = 64
+
+// UserDirectory resolves the users notifications are sent from and to
+// Implementations must be safe for concurrent use
+type UserDirectory interface {
+	// Lookup returns the user with the given ID, or ErrUserNotFound
+	Lookup(id int) (models.User, error)
+	// List returns every user, sorted by ID
+	List() ([]models.User, error)
+	// Group returns the IDs of the members of a named group, or ErrGroupNotFound
+	Group(name string) ([]int, error)
+	// Close releases the resources held by the directory
+	Close() error
+}
+
+// Editor is implemented by the directories that can be changed at runtime
+// The static directory keeps the changes in memory only, the file and SQLite
+// directories persist them, the HTTP directory is read-only
+type Editor interface {
+	// Create adds a user, assigning the next free ID when user.ID is 0
+	// Returns ErrUserExists when the ID is taken
+	Create(user models.User) (models.User, error)
+	// Update replaces the name and deactivated flag of an existing user, or returns ErrUserNotFound
+	Update(user models.User) (models.User, error)
+}
+
+// Config selects and configures a directory backend
+type Config struct {
+	Backend  string
+	Source   string        // File path, SQLite database path or base URL, depending on the backend
+	CacheTTL time.Duration // How long the HTTP backend caches lookups
+}
+
+// Open creates the user directory for the given backend
+func Open(config Config) (UserDirectory, error) {
+	switch config.Backend {
+	case BackendStatic, "":
+		return NewMemoryDirectory(DefaultUsers(), DefaultGroups()), nil
+	case BackendFile:
+		return OpenFileDirectory(config.Source)
+	case BackendSQLite:
+		return OpenSQLiteDirectory(config.Source)
+	case BackendHTTP:
+		return NewHTTPDirectory(config.Source, config.CacheTTL)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBackend, config.Backend)
+	}
+}
+
+// DefaultUsers are the users of the static directory
+func DefaultUsers() []models.User {
+	return []models.User{
+		{ID: 1, Name: "Micho"},
+		{ID: 2, Name: "Tito"},
+		{ID: 3, Name: "Negro"},
+		{ID: 4, Name: "Cabezon"},
+	}
+}
+
+// DefaultGroups are the groups of the static directory
+func DefaultGroups() map[string][]int {
+	return map[string][]int{
+		"friends": {1, 2, 3, 4},
+		"asado":   {1, 3, 4},
+	}
+}
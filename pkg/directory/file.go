@@ -0,0 +1,170 @@
+package directory
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"kafka-notify/pkg/models"
+
+	"github.com/fsnotify/fsnotify"
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidDirectory is returned when a directory source holds inconsistent users or groups
+var ErrInvalidDirectory = errors.New("invalid user directory")
+
+// fileContent is the layout of a directory file, in JSON or YAML:
+//
+//	users:
+//	  - id: 1
+//	    name: Micho
+//	  - id: 2
+//	    name: Tito
+//	    deactivated: true
+//	groups:
+//	  asado: [1, 3, 4]
+type fileContent struct {
+	Users  []models.User    `json:"users" yaml:"users"`
+	Groups map[string][]int `json:"groups,omitempty" yaml:"groups,omitempty"`
+}
+
+// FileDirectory serves the users of a JSON or YAML file, reloading it when it changes
+type FileDirectory struct {
+	*MemoryDirectory
+	path    string
+	watcher *fsnotify.Watcher
+}
+
+// OpenFileDirectory loads the directory file and starts watching it for changes
+// The format is chosen by extension: .yaml and .yml are YAML, anything else is JSON
+func OpenFileDirectory(path string) (*FileDirectory, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: file backend needs a path", ErrInvalidDirectory)
+	}
+	d := &FileDirectory{MemoryDirectory: &MemoryDirectory{}, path: path}
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	watcher, err := watchFile(path, d.load)
+	if err != nil {
+		return nil, err
+	}
+	d.watcher = watcher
+	return d, nil
+}
+
+// isYAML reports whether the file is read and written as YAML
+func (d *FileDirectory) isYAML() bool {
+	switch strings.ToLower(filepath.Ext(d.path)) {
+	case ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+// load reads and validates the file, then replaces the directory content
+func (d *FileDirectory) load() error {
+	data, err := os.ReadFile(d.path)
+	if err != nil {
+		return fmt.Errorf("failed to read user directory %s: %w", d.path, err)
+	}
+	var content fileContent
+	if d.isYAML() {
+		err = yaml.Unmarshal(data, &content)
+	} else {
+		err = json.Unmarshal(data, &content)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to decode user directory %s: %w", d.path, err)
+	}
+	if err := validate(content.Users, content.Groups); err != nil {
+		return err
+	}
+	d.replace(content.Users, content.Groups)
+	return nil
+}
+
+// Create adds a user and rewrites the file
+func (d *FileDirectory) Create(user models.User) (models.User, error) {
+	return d.apply(createUser(user), d.save)
+}
+
+// Update changes a user and rewrites the file
+func (d *FileDirectory) Update(user models.User) (models.User, error) {
+	return d.apply(updateUser(user), d.save)
+}
+
+// save rewrites the whole file with the given users and groups
+// The new content is written to a temporary file first and renamed over the old
+// one, so the file is never left half written
+func (d *FileDirectory) save(_ models.User, users map[int]models.User, groups map[string][]int) error {
+	content := fileContent{Users: make([]models.User, 0, len(users)), Groups: groups}
+	for _, user := range users {
+		content.Users = append(content.Users, user)
+	}
+	sortUsers(content.Users)
+
+	var data []byte
+	var err error
+	if d.isYAML() {
+		data, err = yaml.Marshal(content)
+	} else {
+		data, err = json.MarshalIndent(content, "", "  ")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode user directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(d.path), filepath.Base(d.path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to write user directory %s: %w", d.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	// Keep the permissions of the original file
+	if info, err := os.Stat(d.path); err == nil {
+		tmp.Chmod(info.Mode().Perm())
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write user directory %s: %w", d.path, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write user directory %s: %w", d.path, err)
+	}
+	if err := os.Rename(tmp.Name(), d.path); err != nil {
+		return fmt.Errorf("failed to replace user directory %s: %w", d.path, err)
+	}
+	return nil
+}
+
+// Close stops watching the file
+func (d *FileDirectory) Close() error {
+	return d.watcher.Close()
+}
+
+// validate checks that user IDs are positive and unique and that groups only reference known users
+func validate(users []models.User, groups map[string][]int) error {
+	ids := make(map[int]bool, len(users))
+	for _, user := range users {
+		if user.ID <= 0 {
+			return fmt.Errorf("%w: user ID %d must be positive", ErrInvalidDirectory, user.ID)
+		}
+		if ids[user.ID] {
+			return fmt.Errorf("%w: duplicate user ID %d", ErrInvalidDirectory, user.ID)
+		}
+		ids[user.ID] = true
+	}
+	for name, members := range groups {
+		for _, id := range members {
+			if !ids[id] {
+				return fmt.Errorf("%w: group %q references unknown user %d", ErrInvalidDirectory, name, id)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package directory
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"kafka-notify/pkg/models"
+)
+
+const (
+	// DefaultCacheTTL is used when the HTTP directory is configured without a TTL
+	DefaultCacheTTL = time.Minute
+	// httpTimeout bounds each request to the remote directory
+	httpTimeout = 5 * time.Second
+)
+
+// HTTPDirectory looks users up in a remote service and caches the answers for ttl
+// The service must expose:
+//
+//	GET /users          -> [{"id": 1, "name": "Micho"}, ...]
+//	GET /users/{id}     -> {"id": 1, "name": "Micho"}, 404 when unknown
+//	GET /groups/{name}  -> [1, 3, 4], 404 when unknown
+type HTTPDirectory struct {
+	baseURL string
+	client  *http.Client
+	ttl     time.Duration
+
+	mu     sync.Mutex
+	users  map[int]cached[models.User]
+	groups map[string]cached[[]int]
+	list   cached[[]models.User]
+}
+
+// cached is a remote answer kept until expiresAt
+// A cached err (ErrUserNotFound, ErrGroupNotFound) avoids asking again for unknown entries
+type cached[T any] struct {
+	value     T
+	err       error
+	expiresAt time.Time
+}
+
+func (c cached[T]) fresh(now time.Time) bool {
+	return now.Before(c.expiresAt)
+}
+
+// NewHTTPDirectory creates a directory backed by the service at baseURL
+func NewHTTPDirectory(baseURL string, ttl time.Duration) (*HTTPDirectory, error) {
+	parsed, err := url.Parse(baseURL)
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return nil, fmt.Errorf("%w: invalid directory URL %q", ErrInvalidDirectory, baseURL)
+	}
+	if ttl <= 0 {
+		ttl = DefaultCacheTTL
+	}
+	return &HTTPDirectory{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: httpTimeout},
+		ttl:     ttl,
+		users:   make(map[int]cached[models.User]),
+		groups:  make(map[string]cached[[]int]),
+	}, nil
+}
+
+// Lookup returns the user with the given ID, from the cache when possible
+func (d *HTTPDirectory) Lookup(id int) (models.User, error) {
+	now := time.Now()
+	d.mu.Lock()
+	entry, ok := d.users[id]
+	d.mu.Unlock()
+	if ok && entry.fresh(now) {
+		return entry.value, entry.err
+	}
+
+	var user models.User
+	err := d.get("/users/"+strconv.Itoa(id), &user)
+	if isNotFound(err) {
+		err = fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	} else if err != nil {
+		// Do not cache transient failures
+		return models.User{}, err
+	}
+	d.mu.Lock()
+	d.users[id] = cached[models.User]{value: user, err: err, expiresAt: now.Add(d.ttl)}
+	d.mu.Unlock()
+	return user, err
+}
+
+// List returns every user of the remote directory sorted by ID
+func (d *HTTPDirectory) List() ([]models.User, error) {
+	now := time.Now()
+	d.mu.Lock()
+	entry := d.list
+	d.mu.Unlock()
+	if entry.fresh(now) {
+		return append([]models.User(nil), entry.value...), nil
+	}
+
+	var users []models.User
+	if err := d.get("/users", &users); err != nil {
+		return nil, err
+	}
+	sortUsers(users)
+	d.mu.Lock()
+	d.list = cached[[]models.User]{value: users, expiresAt: now.Add(d.ttl)}
+	// Warm the lookup cache with the listed users
+	for _, user := range users {
+		d.users[user.ID] = cached[models.User]{value: user, expiresAt: now.Add(d.ttl)}
+	}
+	d.mu.Unlock()
+	return append([]models.User(nil), users...), nil
+}
+
+// Group returns the members of a remote group
+func (d *HTTPDirectory) Group(name string) ([]int, error) {
+	now := time.Now()
+	d.mu.Lock()
+	entry, ok := d.groups[name]
+	d.mu.Unlock()
+	if ok && entry.fresh(now) {
+		return append([]int(nil), entry.value...), entry.err
+	}
+
+	var members []int
+	err := d.get("/groups/"+url.PathEscape(name), &members)
+	if isNotFound(err) {
+		err = fmt.Errorf("%w: %q", ErrGroupNotFound, name)
+	} else if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	d.groups[name] = cached[[]int]{value: members, err: err, expiresAt: now.Add(d.ttl)}
+	d.mu.Unlock()
+	return append([]int(nil), members...), err
+}
+
+// Close releases idle connections to the remote directory
+func (d *HTTPDirectory) Close() error {
+	d.client.CloseIdleConnections()
+	return nil
+}
+
+// statusError is a non-200 answer of the remote directory
+type statusError struct {
+	path   string
+	status int
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("user directory returned %d for %s", e.status, e.path)
+}
+
+// isNotFound reports whether the remote directory answered 404
+func isNotFound(err error) bool {
+	statusErr, ok := err.(*statusError)
+	return ok && statusErr.status == http.StatusNotFound
+}
+
+// get decodes the JSON answer of the remote directory for path into out
+func (d *HTTPDirectory) get(path string, out any) error {
+	resp, err := d.client.Get(d.baseURL + path)
+	if err != nil {
+		return fmt.Errorf("failed to query user directory: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &statusError{path: path, status: resp.StatusCode}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode user directory answer for %s: %w", path, err)
+	}
+	return nil
+}
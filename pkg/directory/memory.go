@@ -0,0 +1,169 @@
+package directory
+
+import (
+	"fmt"
+	"maps"
+	"sort"
+	"strings"
+	"sync"
+
+	"kafka-notify/pkg/models"
+)
+
+// MemoryDirectory keeps the users indexed by ID in memory
+// It backs the static directory and caches the file and SQLite directories
+type MemoryDirectory struct {
+	mu     sync.RWMutex
+	users  map[int]models.User
+	groups map[string][]int
+}
+
+// NewMemoryDirectory creates a directory holding the given users and groups
+func NewMemoryDirectory(users []models.User, groups map[string][]int) *MemoryDirectory {
+	d := &MemoryDirectory{}
+	d.replace(users, groups)
+	return d
+}
+
+// replace swaps the whole content of the directory at once
+func (d *MemoryDirectory) replace(users []models.User, groups map[string][]int) {
+	index := make(map[int]models.User, len(users))
+	for _, user := range users {
+		index[user.ID] = user
+	}
+	copied := make(map[string][]int, len(groups))
+	for name, members := range groups {
+		copied[name] = append([]int(nil), members...)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.users = index
+	d.groups = copied
+}
+
+// Lookup returns the user with the given ID
+func (d *MemoryDirectory) Lookup(id int) (models.User, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	user, ok := d.users[id]
+	if !ok {
+		return models.User{}, fmt.Errorf("%w: %d", ErrUserNotFound, id)
+	}
+	return user, nil
+}
+
+// List returns every user sorted by ID
+func (d *MemoryDirectory) List() ([]models.User, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	users := make([]models.User, 0, len(d.users))
+	for _, user := range d.users {
+		users = append(users, user)
+	}
+	sortUsers(users)
+	return users, nil
+}
+
+// Group returns the IDs of the members of a group
+func (d *MemoryDirectory) Group(name string) ([]int, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	members, ok := d.groups[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrGroupNotFound, name)
+	}
+	return append([]int(nil), members...), nil
+}
+
+// Create adds a user in memory, it is lost when the producer restarts
+func (d *MemoryDirectory) Create(user models.User) (models.User, error) {
+	return d.apply(createUser(user), nil)
+}
+
+// Update changes a user in memory, it is lost when the producer restarts
+func (d *MemoryDirectory) Update(user models.User) (models.User, error) {
+	return d.apply(updateUser(user), nil)
+}
+
+// userChange validates and applies a change to a copy of the users, returning the changed user
+type userChange func(users map[int]models.User) (models.User, error)
+
+// apply runs change on a copy of the users and persists the result with save, if any
+// The change only becomes visible once it was saved
+func (d *MemoryDirectory) apply(change userChange,
+	save func(changed models.User, users map[int]models.User, groups map[string][]int) error) (models.User, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	users := maps.Clone(d.users)
+	changed, err := change(users)
+	if err != nil {
+		return models.User{}, err
+	}
+	if save != nil {
+		if err := save(changed, users, d.groups); err != nil {
+			return models.User{}, err
+		}
+	}
+	d.users = users
+	return changed, nil
+}
+
+// createUser adds the user, picking the ID after the highest one when none is given
+func createUser(user models.User) userChange {
+	return func(users map[int]models.User) (models.User, error) {
+		user.Name = strings.TrimSpace(user.Name)
+		if err := validateUser(user); err != nil {
+			return models.User{}, err
+		}
+		if user.ID == 0 {
+			for id := range users {
+				user.ID = max(user.ID, id)
+			}
+			user.ID++
+		}
+		if _, ok := users[user.ID]; ok {
+			return models.User{}, fmt.Errorf("%w: %d", ErrUserExists, user.ID)
+		}
+		users[user.ID] = user
+		return user, nil
+	}
+}
+
+// updateUser replaces an existing user
+func updateUser(user models.User) userChange {
+	return func(users map[int]models.User) (models.User, error) {
+		user.Name = strings.TrimSpace(user.Name)
+		if err := validateUser(user); err != nil {
+			return models.User{}, err
+		}
+		if _, ok := users[user.ID]; !ok {
+			return models.User{}, fmt.Errorf("%w: %d", ErrUserNotFound, user.ID)
+		}
+		users[user.ID] = user
+		return user, nil
+	}
+}
+
+// validateUser checks the fields of a created or updated user
+func validateUser(user models.User) error {
+	if user.ID < 0 {
+		return fmt.Errorf("%w: ID %d must be positive", ErrInvalidUser, user.ID)
+	}
+	if user.Name == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidUser)
+	}
+	if len(user.Name) > MaxNameLength {
+		return fmt.Errorf("%w: name must be at most %d long", ErrInvalidUser, MaxNameLength)
+	}
+	return nil
+}
+
+// Close is a no-op for the memory directory
+func (d *MemoryDirectory) Close() error {
+	return nil
+}
+
+// sortUsers orders users by ID
+func sortUsers(users []models.User) {
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+}
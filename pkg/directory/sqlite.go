@@ -0,0 +1,166 @@
+package directory
+
+import (
+	"database/sql"
+	"fmt"
+
+	"kafka-notify/pkg/models"
+
+	"github.com/fsnotify/fsnotify"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates the directory tables when the database is new
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id          INTEGER PRIMARY KEY,
+	name        TEXT NOT NULL,
+	deactivated INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS group_members (
+	group_name TEXT NOT NULL,
+	user_id    INTEGER NOT NULL REFERENCES users (id),
+	PRIMARY KEY (group_name, user_id)
+);`
+
+// SQLiteDirectory serves the users of an embedded SQLite database
+// The tables are loaded into memory so lookups never hit the disk, and are
+// reloaded when another process changes the database file
+type SQLiteDirectory struct {
+	*MemoryDirectory
+	db      *sql.DB
+	path    string
+	watcher *fsnotify.Watcher
+}
+
+// OpenSQLiteDirectory opens or creates the database at path and loads its users
+func OpenSQLiteDirectory(path string) (*SQLiteDirectory, error) {
+	if path == "" {
+		return nil, fmt.Errorf("%w: sqlite backend needs a database path", ErrInvalidDirectory)
+	}
+	db, err := sql.Open("sqlite3", path+"?_foreign_keys=on&_busy_timeout=5000")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open user database %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create user database schema: %w", err)
+	}
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	d := &SQLiteDirectory{MemoryDirectory: &MemoryDirectory{}, db: db, path: path}
+	if err := d.load(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	watcher, err := watchFile(path, d.load)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	d.watcher = watcher
+	return d, nil
+}
+
+// load reads every user and group membership into memory
+func (d *SQLiteDirectory) load() error {
+	rows, err := d.db.Query(`SELECT id, name, deactivated FROM users ORDER BY id`)
+	if err != nil {
+		return fmt.Errorf("failed to query users: %w", err)
+	}
+	defer rows.Close()
+	var users []models.User
+	for rows.Next() {
+		var user models.User
+		if err := rows.Scan(&user.ID, &user.Name, &user.Deactivated); err != nil {
+			return fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to query users: %w", err)
+	}
+
+	memberRows, err := d.db.Query(`SELECT group_name, user_id FROM group_members ORDER BY group_name, user_id`)
+	if err != nil {
+		return fmt.Errorf("failed to query groups: %w", err)
+	}
+	defer memberRows.Close()
+	groups := make(map[string][]int)
+	for memberRows.Next() {
+		var name string
+		var id int
+		if err := memberRows.Scan(&name, &id); err != nil {
+			return fmt.Errorf("failed to scan group member: %w", err)
+		}
+		groups[name] = append(groups[name], id)
+	}
+	if err := memberRows.Err(); err != nil {
+		return fmt.Errorf("failed to query groups: %w", err)
+	}
+
+	d.replace(users, groups)
+	return nil
+}
+
+// Create inserts a user in the database
+func (d *SQLiteDirectory) Create(user models.User) (models.User, error) {
+	return d.apply(createUser(user), func(created models.User, _ map[int]models.User, _ map[string][]int) error {
+		_, err := d.db.Exec(`INSERT INTO users (id, name, deactivated) VALUES (?, ?, ?)`,
+			created.ID, created.Name, created.Deactivated)
+		if err != nil {
+			return fmt.Errorf("failed to insert user %d: %w", created.ID, err)
+		}
+		return nil
+	})
+}
+
+// Update changes a user in the database
+func (d *SQLiteDirectory) Update(user models.User) (models.User, error) {
+	return d.apply(updateUser(user), func(updated models.User, _ map[int]models.User, _ map[string][]int) error {
+		_, err := d.db.Exec(`UPDATE users SET name = ?, deactivated = ? WHERE id = ?`,
+			updated.Name, updated.Deactivated, updated.ID)
+		if err != nil {
+			return fmt.Errorf("failed to update user %d: %w", updated.ID, err)
+		}
+		return nil
+	})
+}
+
+// migrateSQLite adds the columns missing from databases created by older versions
+func migrateSQLite(db *sql.DB) error {
+	rows, err := db.Query(`SELECT name FROM pragma_table_info('users')`)
+	if err != nil {
+		return fmt.Errorf("failed to inspect user database schema: %w", err)
+	}
+	defer rows.Close()
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return fmt.Errorf("failed to inspect user database schema: %w", err)
+		}
+		columns[column] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to inspect user database schema: %w", err)
+	}
+	// Release the read before altering the table
+	rows.Close()
+
+	if !columns["deactivated"] {
+		if _, err := db.Exec(`ALTER TABLE users ADD COLUMN deactivated INTEGER NOT NULL DEFAULT 0`); err != nil {
+			return fmt.Errorf("failed to add deactivated column: %w", err)
+		}
+	}
+	return nil
+}
+
+// Close stops watching the database and closes it
+func (d *SQLiteDirectory) Close() error {
+	d.watcher.Close()
+	return d.db.Close()
+}
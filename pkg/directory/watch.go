@@ -0,0 +1,59 @@
+package directory
+
+import (
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/fsnotify/fsnotify"
+)
+
+// reloadDebounce groups the bursts of events a single save produces into one reload
+const reloadDebounce = 200 * time.Millisecond
+
+// watchFile calls reload whenever the file changes, until the returned watcher is closed
+// The parent directory is watched so editors that save by renaming a new file are handled
+func watchFile(path string, reload func() error) (*fsnotify.Watcher, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %w", path, err)
+	}
+
+	target := filepath.Clean(path)
+	go func() {
+		var debounce <-chan time.Time
+		for {
+			select {
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != target {
+					continue
+				}
+				if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+					debounce = time.After(reloadDebounce)
+				}
+			case <-debounce:
+				debounce = nil
+				// Keep serving the previous users when the new content is invalid
+				if err := reload(); err != nil {
+					logger.Error("Failed to reload user directory", "path", path, "error", err)
+					continue
+				}
+				logger.Info("User directory reloaded", "path", path)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				logger.Error("User directory watcher error", "path", path, "error", err)
+			}
+		}
+	}()
+	return watcher, nil
+}
@@ -0,0 +1,94 @@
+package dlq
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"kafka-notify/pkg/metrics"
+
+	"github.com/IBM/sarama"
+	"github.com/alejoacosta74/go-logger"
+)
+
+// Headers attached to every dead-lettered message
+const (
+	HeaderError             = "dlq-error"
+	HeaderOriginalTopic     = "dlq-original-topic"
+	HeaderOriginalPartition = "dlq-original-partition"
+	HeaderOriginalOffset    = "dlq-original-offset"
+	HeaderOriginalTimestamp = "dlq-original-timestamp"
+	HeaderFailedAt          = "dlq-failed-at"
+)
+
+// headerPrefix identifies the headers added by the dead-letter forwarder
+const headerPrefix = "dlq-"
+
+// Forwarder publishes messages that cannot be processed to a dead-letter topic
+type Forwarder struct {
+	producer sarama.SyncProducer
+	topic    string
+}
+
+// NewForwarder creates a forwarder publishing to the given dead-letter topic
+func NewForwarder(brokers []string, topic string) (*Forwarder, error) {
+	config := sarama.NewConfig()
+	// Dead letters must not be lost, wait for every in-sync replica
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		logger.Error("Failed to setup dead-letter producer", "error", err)
+		return nil, fmt.Errorf("failed to setup dead-letter producer: %w", err)
+	}
+	return &Forwarder{producer: metrics.InstrumentSyncProducer(producer), topic: topic}, nil
+}
+
+// Forward publishes the message to the dead-letter topic with headers describing
+// the failure and where the message originally came from
+func (f *Forwarder) Forward(msg *sarama.ConsumerMessage, cause error) error {
+	headers := make([]sarama.RecordHeader, 0, len(msg.Headers)+6)
+	// Keep the original headers so a redrive reproduces the message exactly
+	for _, header := range msg.Headers {
+		if header != nil {
+			headers = append(headers, *header)
+		}
+	}
+	headers = append(headers,
+		stringHeader(HeaderError, cause.Error()),
+		stringHeader(HeaderOriginalTopic, msg.Topic),
+		stringHeader(HeaderOriginalPartition, strconv.Itoa(int(msg.Partition))),
+		stringHeader(HeaderOriginalOffset, strconv.FormatInt(msg.Offset, 10)),
+		stringHeader(HeaderOriginalTimestamp, msg.Timestamp.UTC().Format(time.RFC3339Nano)),
+		stringHeader(HeaderFailedAt, time.Now().UTC().Format(time.RFC3339Nano)),
+	)
+
+	partition, offset, err := f.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:   f.topic,
+		Key:     sarama.ByteEncoder(msg.Key),
+		Value:   sarama.ByteEncoder(msg.Value),
+		Headers: headers,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to forward message to dead-letter topic %s: %w", f.topic, err)
+	}
+	logger.Warn("Message forwarded to dead-letter topic", "topic", f.topic,
+		"partition", partition, "offset", offset, "error", cause)
+	return nil
+}
+
+// Close closes the underlying producer
+func (f *Forwarder) Close() error {
+	return f.producer.Close()
+}
+
+// stringHeader builds a record header with a string value
+func stringHeader(key, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
+
+// isDLQHeader reports whether a header was added by the forwarder
+func isDLQHeader(header sarama.RecordHeader) bool {
+	return strings.HasPrefix(string(header.Key), headerPrefix)
+}
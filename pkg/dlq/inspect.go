@@ -0,0 +1,180 @@
+package dlq
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/alejoacosta74/go-logger"
+)
+
+// readTimeout bounds how long to wait for the next message of a partition
+const readTimeout = 10 * time.Second
+
+// ErrReadTimeout is returned when a dead-letter partition stops delivering messages
+var ErrReadTimeout = errors.New("timed out reading dead-letter topic")
+
+// Entry is a dead-lettered message decoded from the dead-letter topic
+type Entry struct {
+	Partition         int32                 `json:"partition"`
+	Offset            int64                 `json:"offset"`
+	Key               string                `json:"key"`
+	Value             string                `json:"value"`
+	Error             string                `json:"error"`
+	OriginalTopic     string                `json:"originalTopic"`
+	OriginalPartition int32                 `json:"originalPartition"`
+	OriginalOffset    int64                 `json:"originalOffset"`
+	OriginalTimestamp string                `json:"originalTimestamp"`
+	FailedAt          string                `json:"failedAt"`
+	Headers           []sarama.RecordHeader `json:"-"` // Original headers, without the dead-letter ones
+}
+
+// Read returns the messages currently held in the dead-letter topic, oldest first per partition
+// A limit of 0 returns every message
+func Read(brokers []string, topic string, limit int) ([]Entry, error) {
+	client, err := sarama.NewClient(brokers, sarama.NewConfig())
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to Kafka: %w", err)
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create consumer: %w", err)
+	}
+	defer consumer.Close()
+
+	partitions, err := consumer.Partitions(topic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list partitions of %s: %w", topic, err)
+	}
+
+	var entries []Entry
+	for _, partition := range partitions {
+		remaining := 0
+		if limit > 0 {
+			if remaining = limit - len(entries); remaining <= 0 {
+				break
+			}
+		}
+		partitionEntries, err := readPartition(client, consumer, topic, partition, remaining)
+		if err != nil {
+			return entries, err
+		}
+		entries = append(entries, partitionEntries...)
+	}
+	return entries, nil
+}
+
+// readPartition reads a partition from the oldest offset up to its current high-water mark
+func readPartition(client sarama.Client, consumer sarama.Consumer,
+	topic string, partition int32, limit int) ([]Entry, error) {
+	oldest, err := client.GetOffset(topic, partition, sarama.OffsetOldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get oldest offset of %s/%d: %w", topic, partition, err)
+	}
+	newest, err := client.GetOffset(topic, partition, sarama.OffsetNewest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get newest offset of %s/%d: %w", topic, partition, err)
+	}
+	if oldest >= newest {
+		// Empty partition
+		return nil, nil
+	}
+
+	partitionConsumer, err := consumer.ConsumePartition(topic, partition, oldest)
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume %s/%d: %w", topic, partition, err)
+	}
+	defer partitionConsumer.Close()
+
+	var entries []Entry
+	for {
+		select {
+		case msg := <-partitionConsumer.Messages():
+			entries = append(entries, decodeEntry(msg))
+			if msg.Offset >= newest-1 || (limit > 0 && len(entries) >= limit) {
+				return entries, nil
+			}
+		case <-time.After(readTimeout):
+			return entries, fmt.Errorf("%w: %s/%d", ErrReadTimeout, topic, partition)
+		}
+	}
+}
+
+// decodeEntry extracts the failure details from the dead-letter headers
+func decodeEntry(msg *sarama.ConsumerMessage) Entry {
+	entry := Entry{
+		Partition: msg.Partition,
+		Offset:    msg.Offset,
+		Key:       string(msg.Key),
+		Value:     string(msg.Value),
+	}
+	for _, header := range msg.Headers {
+		if header == nil {
+			continue
+		}
+		if !isDLQHeader(*header) {
+			entry.Headers = append(entry.Headers, *header)
+			continue
+		}
+		value := string(header.Value)
+		switch string(header.Key) {
+		case HeaderError:
+			entry.Error = value
+		case HeaderOriginalTopic:
+			entry.OriginalTopic = value
+		case HeaderOriginalPartition:
+			partition, _ := strconv.Atoi(value)
+			entry.OriginalPartition = int32(partition)
+		case HeaderOriginalOffset:
+			entry.OriginalOffset, _ = strconv.ParseInt(value, 10, 64)
+		case HeaderOriginalTimestamp:
+			entry.OriginalTimestamp = value
+		case HeaderFailedAt:
+			entry.FailedAt = value
+		}
+	}
+	return entry
+}
+
+// Redrive publishes the selected dead-lettered messages back to their original topic
+// with their original key, value and headers. Returns how many messages were redriven
+func Redrive(brokers []string, entries []Entry) (int, error) {
+	if len(entries) == 0 {
+		return 0, nil
+	}
+
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return 0, fmt.Errorf("failed to setup redrive producer: %w", err)
+	}
+	defer producer.Close()
+
+	messages := make([]*sarama.ProducerMessage, 0, len(entries))
+	for _, entry := range entries {
+		if entry.OriginalTopic == "" {
+			logger.Warn("Skipping dead letter without original topic", "partition", entry.Partition, "offset", entry.Offset)
+			continue
+		}
+		messages = append(messages, &sarama.ProducerMessage{
+			Topic:   entry.OriginalTopic,
+			Key:     sarama.StringEncoder(entry.Key),
+			Value:   sarama.StringEncoder(entry.Value),
+			Headers: entry.Headers,
+		})
+	}
+	if err := producer.SendMessages(messages); err != nil {
+		var producerErrors sarama.ProducerErrors
+		if errors.As(err, &producerErrors) {
+			return len(messages) - len(producerErrors), fmt.Errorf("failed to redrive %d messages: %w", len(producerErrors), err)
+		}
+		return 0, fmt.Errorf("failed to redrive messages: %w", err)
+	}
+	return len(messages), nil
+}
@@ -0,0 +1,149 @@
+package metrics
+
+import (
+	"strconv"
+	"time"
+
+	"kafka-notify/pkg/outbox"
+	"kafka-notify/pkg/store"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Outcomes of a consumed message
+const (
+	OutcomeStored       = "stored"
+	OutcomeReplayed     = "replayed"
+	OutcomeDuplicate    = "duplicate"
+	OutcomeDeadLettered = "dead_lettered"
+	OutcomeSkipped      = "skipped"
+)
+
+// Reasons a consumed message could not be decoded
+const (
+	DecodeMissingKey  = "missing_key"
+	DecodeContentType = "content_type"
+	DecodeJSON        = "json"
+)
+
+// Every metric is registered on the default registry, which also collects the
+// Go runtime and process metrics
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notify_http_requests_total",
+		Help: "HTTP requests served, by method, route and status",
+	}, []string{"method", "route", "status"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notify_http_request_duration_seconds",
+		Help:    "Time taken to serve HTTP requests, by method, route and status",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method", "route", "status"})
+
+	// ProduceDuration measures how long Kafka takes to acknowledge a message
+	ProduceDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "notify_producer_send_duration_seconds",
+		Help:    "Time taken by Kafka to acknowledge a message, by topic",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"topic"})
+	// ProduceErrors counts the messages Kafka failed to acknowledge
+	ProduceErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notify_producer_send_errors_total",
+		Help: "Messages Kafka failed to acknowledge, by topic",
+	}, []string{"topic"})
+
+	// Consumed counts the messages handled by the consumer by outcome
+	Consumed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notify_consumer_messages_total",
+		Help: "Messages handled by the consumer, by topic and outcome",
+	}, []string{"topic", "outcome"})
+	// DecodeFailures counts the consumed messages that could not be decoded
+	DecodeFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "notify_consumer_decode_failures_total",
+		Help: "Consumed messages that could not be decoded, by topic and reason",
+	}, []string{"topic", "reason"})
+)
+
+// Middleware creates a Gin middleware counting the requests and measuring their latency
+// Requests are labeled with the route pattern, not the path, so user IDs do not
+// create a series each
+func Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		start := time.Now()
+		ctx.Next()
+
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		status := strconv.Itoa(ctx.Writer.Status())
+		httpRequests.WithLabelValues(ctx.Request.Method, route, status).Inc()
+		httpDuration.WithLabelValues(ctx.Request.Method, route, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Handler creates a Gin HTTP handler serving the metrics in the Prometheus text format
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// storeCollector reports the usage of a store at scrape time
+type storeCollector struct {
+	sizer store.Sizer
+}
+
+var (
+	storeUsersDesc = prometheus.NewDesc("notify_store_users",
+		"Users with notifications in the store", nil, nil)
+	storeNotificationsDesc = prometheus.NewDesc("notify_store_notifications",
+		"Notifications held by the store", nil, nil)
+	storeBytesDesc = prometheus.NewDesc("notify_store_bytes",
+		"Bytes used by the store", nil, nil)
+)
+
+// RegisterStore reports the usage of a store, when the backend can measure it
+func RegisterStore(notificationStore store.Store) {
+	sizer, ok := notificationStore.(store.Sizer)
+	if !ok {
+		logger.Warn("Store does not report its usage, store metrics disabled")
+		return
+	}
+	prometheus.MustRegister(storeCollector{sizer: sizer})
+}
+
+// Describe implements prometheus.Collector
+func (c storeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- storeUsersDesc
+	ch <- storeNotificationsDesc
+	ch <- storeBytesDesc
+}
+
+// Collect implements prometheus.Collector
+func (c storeCollector) Collect(ch chan<- prometheus.Metric) {
+	usage, err := c.sizer.Usage()
+	if err != nil {
+		logger.Error("Failed to measure store usage", "error", err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(storeUsersDesc, prometheus.GaugeValue, float64(usage.Users))
+	ch <- prometheus.MustNewConstMetric(storeNotificationsDesc, prometheus.GaugeValue, float64(usage.Notifications))
+	ch <- prometheus.MustNewConstMetric(storeBytesDesc, prometheus.GaugeValue, float64(usage.Bytes))
+}
+
+// RegisterOutbox reports the number of messages waiting in the producer's outbox
+func RegisterOutbox(box *outbox.Outbox) {
+	prometheus.MustRegister(newOutboxDepth(box))
+}
+
+// newOutboxDepth creates a gauge reading the outbox depth at scrape time
+func newOutboxDepth(box *outbox.Outbox) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "notify_outbox_depth",
+		Help: "Messages written to the outbox and not yet published to Kafka",
+	}, func() float64 {
+		return float64(box.Depth())
+	})
+}
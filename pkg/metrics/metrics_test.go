@@ -0,0 +1,41 @@
+package metrics
+
+import (
+	"path/filepath"
+	"testing"
+
+	"kafka-notify/pkg/outbox"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// gauge returns the value of an unlabeled gauge of registry
+func gauge(t *testing.T, registry prometheus.Gatherer, name string) float64 {
+	families, err := registry.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			return family.GetMetric()[0].GetGauge().GetValue()
+		}
+	}
+	t.Fatalf("metric %s not registered", name)
+	return 0
+}
+
+func TestOutboxDepthGauge(t *testing.T) {
+	box, err := outbox.Open(filepath.Join(t.TempDir(), "outbox.db"))
+	require.NoError(t, err)
+	defer box.Close()
+	// A registry of its own so the test can run repeatedly
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newOutboxDepth(box))
+
+	assert.Zero(t, gauge(t, registry, "notify_outbox_depth"))
+	entry, err := box.Enqueue("a", "notifications", "1", []byte("a"), nil)
+	require.NoError(t, err)
+	assert.Equal(t, float64(1), gauge(t, registry, "notify_outbox_depth"))
+	require.NoError(t, box.Delete(entry.Seq))
+	assert.Zero(t, gauge(t, registry, "notify_outbox_depth"))
+}
@@ -0,0 +1,94 @@
+package metrics
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+)
+
+// instrumentedProducer times every message sent with a SyncProducer and counts the
+// ones Kafka failed to acknowledge. Messages acknowledged inside a transaction count
+// as failed when the transaction is not committed
+type instrumentedProducer struct {
+	sarama.SyncProducer
+
+	mu      sync.Mutex
+	pending map[string]int // Messages acknowledged per topic in the open transaction
+}
+
+// InstrumentSyncProducer wraps a producer so every send is recorded in ProduceDuration
+// and ProduceErrors
+func InstrumentSyncProducer(producer sarama.SyncProducer) sarama.SyncProducer {
+	return &instrumentedProducer{SyncProducer: producer, pending: make(map[string]int)}
+}
+
+// SendMessage implements sarama.SyncProducer
+func (p *instrumentedProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	start := time.Now()
+	partition, offset, err := p.SyncProducer.SendMessage(msg)
+	p.record(msg, time.Since(start), err != nil)
+	return partition, offset, err
+}
+
+// SendMessages implements sarama.SyncProducer
+// Every message of the batch is observed with the latency of the whole batch
+func (p *instrumentedProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	start := time.Now()
+	err := p.SyncProducer.SendMessages(msgs)
+	elapsed := time.Since(start)
+
+	failed := make(map[*sarama.ProducerMessage]bool)
+	var producerErrors sarama.ProducerErrors
+	if errors.As(err, &producerErrors) {
+		for _, producerErr := range producerErrors {
+			failed[producerErr.Msg] = true
+		}
+	}
+	for _, msg := range msgs {
+		// An error other than ProducerErrors failed the whole batch
+		p.record(msg, elapsed, failed[msg] || (err != nil && len(failed) == 0))
+	}
+	return err
+}
+
+// CommitTxn implements sarama.SyncProducer
+func (p *instrumentedProducer) CommitTxn() error {
+	err := p.SyncProducer.CommitTxn()
+	p.endTxn(err != nil)
+	return err
+}
+
+// AbortTxn implements sarama.SyncProducer
+func (p *instrumentedProducer) AbortTxn() error {
+	err := p.SyncProducer.AbortTxn()
+	p.endTxn(true)
+	return err
+}
+
+// record observes a message sent in elapsed
+func (p *instrumentedProducer) record(msg *sarama.ProducerMessage, elapsed time.Duration, failed bool) {
+	ProduceDuration.WithLabelValues(msg.Topic).Observe(elapsed.Seconds())
+	if failed {
+		ProduceErrors.WithLabelValues(msg.Topic).Inc()
+		return
+	}
+	if p.IsTransactional() {
+		p.mu.Lock()
+		p.pending[msg.Topic]++
+		p.mu.Unlock()
+	}
+}
+
+// endTxn counts the messages of a transaction that was rolled back as failed
+func (p *instrumentedProducer) endTxn(rolledBack bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for topic, count := range p.pending {
+		if rolledBack {
+			ProduceErrors.WithLabelValues(topic).Add(float64(count))
+		}
+		delete(p.pending, topic)
+	}
+}
@@ -0,0 +1,86 @@
+package metrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// produced returns how many messages of topic were timed and how many failed
+func produced(t *testing.T, topic string) (sent uint64, failed float64) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != 1 || metric.GetLabel()[0].GetValue() != topic {
+				continue
+			}
+			switch family.GetName() {
+			case "notify_producer_send_duration_seconds":
+				sent = metric.GetHistogram().GetSampleCount()
+			case "notify_producer_send_errors_total":
+				failed = metric.GetCounter().GetValue()
+			}
+		}
+	}
+	return sent, failed
+}
+
+func TestInstrumentedProducerRecordsSends(t *testing.T) {
+	const topic = "instrumented-sends"
+	// The metrics are global, only what this run adds is checked
+	sentBefore, failedBefore := produced(t, topic)
+	mock := mocks.NewSyncProducer(t, nil)
+	producer := InstrumentSyncProducer(mock)
+	mock.ExpectSendMessageAndSucceed()
+	mock.ExpectSendMessageAndFail(errors.New("broker unavailable"))
+	mock.ExpectSendMessageAndSucceed()
+	mock.ExpectSendMessageAndSucceed()
+
+	_, _, err := producer.SendMessage(&sarama.ProducerMessage{Topic: topic})
+	require.NoError(t, err)
+	_, _, err = producer.SendMessage(&sarama.ProducerMessage{Topic: topic})
+	require.Error(t, err)
+	require.NoError(t, producer.SendMessages([]*sarama.ProducerMessage{{Topic: topic}, {Topic: topic}}))
+	require.NoError(t, producer.Close())
+
+	sent, failed := produced(t, topic)
+	assert.Equal(t, uint64(4), sent-sentBefore)
+	assert.Equal(t, float64(1), failed-failedBefore)
+}
+
+func TestInstrumentedProducerCountsAbortedTransactions(t *testing.T) {
+	const topic = "instrumented-transactions"
+	config := sarama.NewConfig()
+	config.Version = sarama.V2_5_0_0
+	config.Producer.Idempotent = true
+	config.Producer.RequiredAcks = sarama.WaitForAll
+	config.Producer.Return.Successes = true
+	config.Producer.Transaction.ID = "test"
+	config.Net.MaxOpenRequests = 1
+	sentBefore, failedBefore := produced(t, topic)
+	mock := mocks.NewSyncProducer(t, config)
+	producer := InstrumentSyncProducer(mock)
+	for i := 0; i < 4; i++ {
+		mock.ExpectSendMessageAndSucceed()
+	}
+
+	// Committed messages were delivered
+	require.NoError(t, producer.BeginTxn())
+	require.NoError(t, producer.SendMessages([]*sarama.ProducerMessage{{Topic: topic}, {Topic: topic}}))
+	require.NoError(t, producer.CommitTxn())
+	// Every message of an aborted transaction failed, even the acknowledged ones
+	require.NoError(t, producer.BeginTxn())
+	require.NoError(t, producer.SendMessages([]*sarama.ProducerMessage{{Topic: topic}, {Topic: topic}}))
+	require.NoError(t, producer.AbortTxn())
+	require.NoError(t, producer.Close())
+
+	sent, failed := produced(t, topic)
+	assert.Equal(t, uint64(4), sent-sentBefore)
+	assert.Equal(t, float64(2), failed-failedBefore)
+}
@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Kafka message headers attached by the producer to every notification
+const (
+	HeaderContentType    = "content-type"
+	HeaderSchemaVersion  = "schema-version"
+	HeaderNotificationID = "notification-id"
+	HeaderCorrelationID  = "correlation-id"
+	HeaderProducerHost   = "producer-host"
+	HeaderProducedAt     = "produced-at" // RFC 3339 with nanoseconds
+)
+
+const (
+	// ContentTypeJSON is the content type of notification messages
+	ContentTypeJSON = "application/json"
+	// SchemaVersion is the version of the notification JSON written by this producer
+	SchemaVersion = "1"
+)
+
+// Trace describes where a notification comes from, to follow it end to end
+// The producer sends it as message headers rather than in the JSON value and only
+// sets the correlation ID itself, the consumer fills in the rest from the headers
+type Trace struct {
+	CorrelationID string     `json:"correlationId,omitempty"`
+	SchemaVersion string     `json:"schemaVersion,omitempty"`
+	ProducerHost  string     `json:"producerHost,omitempty"`
+	ProducedAt    *time.Time `json:"producedAt,omitempty"`
+}
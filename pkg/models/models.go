@@ -1,13 +1,71 @@
 package models
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// User is a sender or recipient of notifications
+// Deactivated users are kept in the directory but cannot send or receive notifications
 type User struct {
-	ID   int    `json:"id"`
-	Name string `json:"name"`
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Deactivated bool   `json:"deactivated,omitempty"`
+}
+
+// Kind is the type of a notification
+type Kind string
+
+const (
+	KindMessage Kind = "message" // Plain message, used when no kind is given
+	KindFollow  Kind = "follow"
+	KindMention Kind = "mention"
+	KindLike    Kind = "like"
+)
+
+// ErrInvalidKind is returned when a notification kind is not supported
+var ErrInvalidKind = errors.New("invalid notification kind")
+
+// ParseKind validates a notification kind, an empty string defaults to KindMessage
+func ParseKind(value string) (Kind, error) {
+	switch kind := Kind(value); kind {
+	case "":
+		return KindMessage, nil
+	case KindMessage, KindFollow, KindMention, KindLike:
+		return kind, nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidKind, value)
+	}
 }
 
 // Notification is a struct that represents a notification topic
+// ID, Kind, CreatedAt and Metadata are missing from messages produced before
+// they were introduced, consumers must fill them in when decoding
+// IdempotencyKey is optionally supplied by the sender so retried sends are delivered once
 type Notification struct {
-	From    User   `json:"from"`
-	To      User   `json:"to"`
-	Message string `json:"message"`
+	ID             string            `json:"id,omitempty"`
+	IdempotencyKey string            `json:"idempotencyKey,omitempty"`
+	Kind           Kind              `json:"kind,omitempty"`
+	From           User              `json:"from"`
+	To             User              `json:"to"`
+	Message        string            `json:"message"`
+	CreatedAt      time.Time         `json:"createdAt"`
+	Metadata       map[string]string `json:"metadata,omitempty"`
+	Trace          *Trace            `json:"trace,omitempty"`
+}
+
+// NewID generates a random, globally unique notification ID (RFC 4122 version 4 UUID)
+func NewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand only fails when the OS entropy source is broken
+		panic(fmt.Sprintf("failed to generate notification ID: %v", err))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40 // Version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	id := hex.EncodeToString(b[:])
+	return id[0:8] + "-" + id[8:12] + "-" + id[12:16] + "-" + id[16:20] + "-" + id[20:32]
 }
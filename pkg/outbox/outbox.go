@@ -0,0 +1,248 @@
+package outbox
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	bolt "go.etcd.io/bbolt"
+)
+
+// entriesBucket holds the pending messages keyed by big-endian sequence number,
+// so iterating the bucket returns them in the order they were accepted
+var entriesBucket = []byte("entries")
+
+// ErrEntryNotFound is returned when an outbox entry was already published or never existed
+var ErrEntryNotFound = errors.New("outbox entry not found")
+
+// Entry is a message accepted by the producer and waiting to be published to Kafka
+type Entry struct {
+	Seq           uint64    `json:"seq"`
+	ID            string    `json:"id"` // Notification ID
+	Topic         string    `json:"topic"`
+	Key           string    `json:"key"` // Recipient ID, messages of the same key are published in order
+	Value         []byte    `json:"-"`
+	Headers       []Header  `json:"headers,omitempty"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	EnqueuedAt    time.Time `json:"enqueuedAt"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+}
+
+// Header is a Kafka message header of an entry
+type Header struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// storedEntry is the encoding of an entry in the database, Value included
+type storedEntry struct {
+	Entry
+	Value []byte `json:"value"`
+}
+
+// Outbox is a durable queue of messages backed by an embedded bbolt database file
+// Every write is fsynced before returning, so accepted messages survive crashes
+type Outbox struct {
+	db *bolt.DB
+	// notify wakes the relay when a message is enqueued
+	notify chan struct{}
+
+	mu    sync.Mutex
+	depth int
+}
+
+// Open opens (or creates) the outbox database file at path
+func Open(path string) (*Outbox, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox %s: %w", path, err)
+	}
+	depth := 0
+	err = db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return err
+		}
+		depth = bucket.Stats().KeyN
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize outbox: %w", err)
+	}
+	return &Outbox{db: db, notify: make(chan struct{}, 1), depth: depth}, nil
+}
+
+// Enqueue durably stores a message to be published with its headers
+func (o *Outbox) Enqueue(id, topic, key string, value []byte, headers []sarama.RecordHeader) (Entry, error) {
+	now := time.Now().UTC()
+	entry := storedEntry{
+		Entry: Entry{ID: id, Topic: topic, Key: key, EnqueuedAt: now, NextAttemptAt: now},
+		Value: value,
+	}
+	for _, header := range headers {
+		entry.Headers = append(entry.Headers, Header{Key: string(header.Key), Value: string(header.Value)})
+	}
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		seq, err := bucket.NextSequence()
+		if err != nil {
+			return err
+		}
+		entry.Seq = seq
+		return putEntry(bucket, entry)
+	})
+	if err != nil {
+		return Entry{}, fmt.Errorf("failed to enqueue message %s: %w", id, err)
+	}
+
+	o.mu.Lock()
+	o.depth++
+	o.mu.Unlock()
+	// Wake the relay without blocking when it was already notified
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+	entry.Entry.Value = entry.Value
+	return entry.Entry, nil
+}
+
+// List returns up to limit entries with a sequence number greater than after,
+// in publishing order and with their values. A limit of 0 returns every entry
+func (o *Outbox) List(after uint64, limit int) ([]Entry, error) {
+	var entries []Entry
+	err := o.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(entriesBucket).Cursor()
+		for k, v := cursor.Seek(itob(after + 1)); k != nil; k, v = cursor.Next() {
+			if limit > 0 && len(entries) >= limit {
+				break
+			}
+			var stored storedEntry
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			stored.Entry.Value = stored.Value
+			entries = append(entries, stored.Entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list outbox: %w", err)
+	}
+	return entries, nil
+}
+
+// Stuck returns up to limit entries that already failed at least once, oldest first
+func (o *Outbox) Stuck(limit int) ([]Entry, error) {
+	var entries []Entry
+	err := o.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(entriesBucket).Cursor()
+		for k, v := cursor.First(); k != nil && (limit <= 0 || len(entries) < limit); k, v = cursor.Next() {
+			var stored storedEntry
+			if err := json.Unmarshal(v, &stored); err != nil {
+				return err
+			}
+			if stored.Attempts > 0 {
+				entries = append(entries, stored.Entry)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list stuck outbox entries: %w", err)
+	}
+	return entries, nil
+}
+
+// Oldest returns when the oldest waiting entry was enqueued, false when the outbox is empty
+func (o *Outbox) Oldest() (time.Time, bool, error) {
+	entries, err := o.List(0, 1)
+	if err != nil || len(entries) == 0 {
+		return time.Time{}, false, err
+	}
+	return entries[0].EnqueuedAt, true, nil
+}
+
+// Delete removes a published entry
+func (o *Outbox) Delete(seq uint64) error {
+	deleted := false
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		if bucket.Get(itob(seq)) == nil {
+			return nil
+		}
+		deleted = true
+		return bucket.Delete(itob(seq))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete outbox entry %d: %w", seq, err)
+	}
+	if deleted {
+		o.mu.Lock()
+		o.depth--
+		o.mu.Unlock()
+	}
+	return nil
+}
+
+// RecordFailure stores a failed publishing attempt and when to try again
+func (o *Outbox) RecordFailure(seq uint64, cause error, nextAttemptAt time.Time) error {
+	err := o.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		v := bucket.Get(itob(seq))
+		if v == nil {
+			return ErrEntryNotFound
+		}
+		var stored storedEntry
+		if err := json.Unmarshal(v, &stored); err != nil {
+			return err
+		}
+		stored.Attempts++
+		stored.LastError = cause.Error()
+		stored.NextAttemptAt = nextAttemptAt.UTC()
+		return putEntry(bucket, stored)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record outbox failure %d: %w", seq, err)
+	}
+	return nil
+}
+
+// Depth returns the number of messages waiting to be published
+func (o *Outbox) Depth() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.depth
+}
+
+// Notify returns the channel signaled when a message is enqueued
+func (o *Outbox) Notify() <-chan struct{} {
+	return o.notify
+}
+
+// Close closes the database
+func (o *Outbox) Close() error {
+	return o.db.Close()
+}
+
+// putEntry encodes and stores an entry under its sequence number
+func putEntry(bucket *bolt.Bucket, entry storedEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return bucket.Put(itob(entry.Seq), data)
+}
+
+// itob encodes a sequence number as a big-endian key so keys sort numerically
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
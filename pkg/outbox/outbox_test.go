@@ -0,0 +1,64 @@
+package outbox
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// openTestOutbox opens an outbox in a temporary file closed when the test ends
+func openTestOutbox(t *testing.T, path string) *Outbox {
+	box, err := Open(path)
+	require.NoError(t, err)
+	t.Cleanup(func() { box.Close() })
+	return box
+}
+
+func TestEntriesSurviveReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "outbox.db")
+	box := openTestOutbox(t, path)
+	headers := []sarama.RecordHeader{{Key: []byte("correlation-id"), Value: []byte("abc")}}
+	first, err := box.Enqueue("a", "notifications", "1", []byte("first"), headers)
+	require.NoError(t, err)
+	second, err := box.Enqueue("b", "notifications", "2", []byte("second"), nil)
+	require.NoError(t, err)
+	_, err = box.Enqueue("c", "notifications", "1", []byte("third"), nil)
+	require.NoError(t, err)
+	require.NoError(t, box.Delete(second.Seq))
+	next := time.Now().Add(time.Minute)
+	require.NoError(t, box.RecordFailure(first.Seq, errors.New("broker unavailable"), next))
+	require.NoError(t, box.Close())
+
+	box = openTestOutbox(t, path)
+	assert.Equal(t, 2, box.Depth())
+	entries, err := box.List(0, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "a", entries[0].ID)
+	assert.Equal(t, []byte("first"), entries[0].Value)
+	assert.Equal(t, []Header{{Key: "correlation-id", Value: "abc"}}, entries[0].Headers)
+	assert.Equal(t, 1, entries[0].Attempts)
+	assert.Equal(t, "broker unavailable", entries[0].LastError)
+	assert.WithinDuration(t, next, entries[0].NextAttemptAt, time.Millisecond)
+	assert.Equal(t, "c", entries[1].ID)
+
+	// Sequence numbers keep growing after a reopen, so new entries go last
+	fourth, err := box.Enqueue("d", "notifications", "1", []byte("fourth"), nil)
+	require.NoError(t, err)
+	assert.Greater(t, fourth.Seq, entries[1].Seq)
+}
+
+func TestDeleteMissingEntryKeepsDepth(t *testing.T) {
+	box := openTestOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	entry, err := box.Enqueue("a", "notifications", "1", []byte("first"), nil)
+	require.NoError(t, err)
+	require.NoError(t, box.Delete(entry.Seq))
+	require.NoError(t, box.Delete(entry.Seq))
+	assert.Zero(t, box.Depth())
+	assert.ErrorIs(t, box.RecordFailure(entry.Seq, errors.New("late"), time.Now()), ErrEntryNotFound)
+}
@@ -0,0 +1,169 @@
+package outbox
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/alejoacosta74/go-logger"
+)
+
+const (
+	// pollInterval is how often the relay retries when nothing was enqueued
+	pollInterval = time.Second
+	// relayBatch bounds how many entries are read from the outbox per pass
+	relayBatch = 500
+	// MinBackoff is the wait after the first failed attempt, doubled on every failure
+	MinBackoff = 500 * time.Millisecond
+	// MaxBackoff caps the wait between attempts of an entry
+	MaxBackoff = time.Minute
+)
+
+// RelayStats reports the outbox depth and the relay activity
+type RelayStats struct {
+	Depth          int        `json:"depth"`
+	OldestAge      float64    `json:"oldestAgeSeconds"` // Age of the oldest waiting entry
+	Published      int64      `json:"published"`
+	FailedAttempts int64      `json:"failedAttempts"`
+	LastError      string     `json:"lastError,omitempty"`
+	LastErrorAt    *time.Time `json:"lastErrorAt,omitempty"`
+	LastPublishAt  *time.Time `json:"lastPublishAt,omitempty"`
+}
+
+// Relay publishes the outbox entries to Kafka and deletes them once acknowledged
+// Entries of the same key are published strictly in order: when one fails, the
+// later entries of its key wait until it goes through
+type Relay struct {
+	outbox   *Outbox
+	producer sarama.SyncProducer
+
+	mu    sync.Mutex
+	stats RelayStats
+}
+
+// NewRelay creates a relay publishing the outbox entries with producer
+func NewRelay(outbox *Outbox, producer sarama.SyncProducer) *Relay {
+	return &Relay{outbox: outbox, producer: producer}
+}
+
+// Run publishes entries as they are enqueued until the context is cancelled
+func (r *Relay) Run(ctx context.Context) {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		r.relay(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-r.outbox.Notify():
+		case <-ticker.C:
+		}
+	}
+}
+
+// relay makes one pass over the outbox, oldest entries first
+// A pass stops at the first failure so an unavailable broker costs one attempt per pass
+func (r *Relay) relay(ctx context.Context) {
+	now := time.Now()
+	blocked := make(map[string]bool)
+	var after uint64
+	for ctx.Err() == nil {
+		entries, err := r.outbox.List(after, relayBatch)
+		if err != nil {
+			logger.Error("Failed to read outbox", "error", err)
+			return
+		}
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+			after = entry.Seq
+			if blocked[entry.Key] {
+				continue
+			}
+			if now.Before(entry.NextAttemptAt) {
+				// Waiting for its backoff, the rest of its key must wait too
+				blocked[entry.Key] = true
+				continue
+			}
+			if !r.publish(entry) {
+				return
+			}
+		}
+		if len(entries) < relayBatch {
+			return
+		}
+	}
+}
+
+// publish sends an entry and removes it from the outbox, or schedules its next attempt
+// Returns whether the entry was published
+func (r *Relay) publish(entry Entry) bool {
+	msg := &sarama.ProducerMessage{
+		Topic: entry.Topic,
+		Key:   sarama.StringEncoder(entry.Key),
+		Value: sarama.ByteEncoder(entry.Value),
+	}
+	for _, header := range entry.Headers {
+		msg.Headers = append(msg.Headers, sarama.RecordHeader{Key: []byte(header.Key), Value: []byte(header.Value)})
+	}
+	partition, offset, err := r.producer.SendMessage(msg)
+	if err != nil {
+		next := time.Now().Add(backoff(entry.Attempts + 1))
+		logger.Warn("Failed to publish outbox entry, retrying later", "id", entry.ID,
+			"attempts", entry.Attempts+1, "next", next.Format(time.RFC3339), "error", err)
+		if recordErr := r.outbox.RecordFailure(entry.Seq, err, next); recordErr != nil {
+			logger.Error("Failed to record outbox failure", "error", recordErr)
+		}
+		r.recordFailure(err)
+		return false
+	}
+
+	// A crash before the delete publishes the entry again on restart,
+	// consumers drop the duplicate by notification ID
+	if err := r.outbox.Delete(entry.Seq); err != nil {
+		logger.Error("Failed to delete published outbox entry", "id", entry.ID, "error", err)
+	}
+	r.recordPublish()
+	logger.Info("Outbox entry published", "id", entry.ID, "partition", partition, "offset", offset)
+	return true
+}
+
+// backoff returns the wait before the given attempt, doubling from MinBackoff up to MaxBackoff
+func backoff(attempts int) time.Duration {
+	wait := MinBackoff
+	for i := 1; i < attempts && wait < MaxBackoff; i++ {
+		wait *= 2
+	}
+	return min(wait, MaxBackoff)
+}
+
+func (r *Relay) recordPublish() {
+	now := time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.Published++
+	r.stats.LastPublishAt = &now
+}
+
+func (r *Relay) recordFailure(err error) {
+	now := time.Now().UTC()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats.FailedAttempts++
+	r.stats.LastError = err.Error()
+	r.stats.LastErrorAt = &now
+}
+
+// Stats returns the current outbox depth and relay counters
+func (r *Relay) Stats() RelayStats {
+	r.mu.Lock()
+	stats := r.stats
+	r.mu.Unlock()
+	stats.Depth = r.outbox.Depth()
+	if oldest, ok, err := r.outbox.Oldest(); err == nil && ok {
+		stats.OldestAge = time.Since(oldest).Seconds()
+	}
+	return stats
+}
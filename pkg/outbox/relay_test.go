@@ -0,0 +1,70 @@
+package outbox
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRelayRetriesInOrderPerKey(t *testing.T) {
+	box := openTestOutbox(t, filepath.Join(t.TempDir(), "outbox.db"))
+	for _, entry := range []struct{ id, key string }{{"a1", "A"}, {"a2", "A"}, {"b1", "B"}} {
+		_, err := box.Enqueue(entry.id, "notifications", entry.key, []byte(entry.id), nil)
+		require.NoError(t, err)
+	}
+
+	var published []string
+	record := func(msg *sarama.ProducerMessage) error {
+		value, _ := msg.Value.Encode()
+		published = append(published, string(value))
+		return nil
+	}
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndFail(record, errors.New("broker unavailable"))
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(record)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(record)
+	producer.ExpectSendMessageWithMessageCheckerFunctionAndSucceed(record)
+	relay := NewRelay(box, producer)
+	ctx := context.Background()
+
+	// The first failure ends the pass and schedules a retry after MinBackoff
+	before := time.Now()
+	relay.relay(ctx)
+	assert.Equal(t, []string{"a1"}, published)
+	stuck, err := box.Stuck(0)
+	require.NoError(t, err)
+	require.Len(t, stuck, 1)
+	assert.Equal(t, "a1", stuck[0].ID)
+	assert.Equal(t, 1, stuck[0].Attempts)
+	assert.Equal(t, "broker unavailable", stuck[0].LastError)
+	assert.WithinDuration(t, before.Add(MinBackoff), stuck[0].NextAttemptAt, 100*time.Millisecond)
+	stats := relay.Stats()
+	assert.Equal(t, 3, stats.Depth)
+	assert.Equal(t, int64(1), stats.FailedAttempts)
+
+	// While a1 waits for its backoff a2 waits too, other keys go through
+	relay.relay(ctx)
+	assert.Equal(t, []string{"a1", "b1"}, published)
+
+	time.Sleep(MinBackoff + 50*time.Millisecond)
+	relay.relay(ctx)
+	assert.Equal(t, []string{"a1", "b1", "a1", "a2"}, published)
+	assert.Zero(t, box.Depth())
+	assert.Equal(t, int64(3), relay.Stats().Published)
+	require.NoError(t, producer.Close())
+}
+
+func TestBackoffDoublesUpToMax(t *testing.T) {
+	assert.Equal(t, MinBackoff, backoff(1))
+	assert.Equal(t, 2*MinBackoff, backoff(2))
+	assert.Equal(t, 8*MinBackoff, backoff(4))
+	assert.Equal(t, MaxBackoff, backoff(20))
+	assert.Equal(t, MaxBackoff, backoff(1000))
+}
@@ -0,0 +1,39 @@
+package producer
+
+import (
+	"kafka-notify/pkg/models"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HTTP headers carrying the correlation ID of a request
+const (
+	CorrelationIDHeader = "X-Correlation-ID"
+	RequestIDHeader     = "X-Request-ID"
+)
+
+// correlationIDKey is the gin context key holding the correlation ID
+const correlationIDKey = "correlationID"
+
+// correlationMiddleware takes the correlation ID from the X-Correlation-ID or
+// X-Request-ID header, or generates one, and echoes it in the response
+// The ID is attached to every notification sent by the request
+func correlationMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := ctx.GetHeader(CorrelationIDHeader)
+		if id == "" {
+			id = ctx.GetHeader(RequestIDHeader)
+		}
+		if id == "" || len(id) > 128 {
+			id = models.NewID()
+		}
+		ctx.Set(correlationIDKey, id)
+		ctx.Header(CorrelationIDHeader, id)
+		ctx.Next()
+	}
+}
+
+// correlationID returns the correlation ID of the request, empty without the middleware
+func correlationID(ctx *gin.Context) string {
+	return ctx.GetString(correlationIDKey)
+}
@@ -0,0 +1,116 @@
+package producer
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// Delivery statuses of an async send
+const (
+	DeliveryPending      = "pending"
+	DeliveryAcknowledged = "acknowledged"
+	DeliveryFailed       = "failed"
+)
+
+// DeliveryRetention is how long a finished delivery can still be queried
+const DeliveryRetention = time.Hour
+
+// ErrDeliveryNotFound is returned when a delivery is unknown or has expired
+var ErrDeliveryNotFound = errors.New("delivery not found")
+
+// Delivery is the outcome of a notification queued on the async producer
+// Partition and offset are set once Kafka acknowledged the message
+type Delivery struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	Partition   *int32     `json:"partition,omitempty"`
+	Offset      *int64     `json:"offset,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	AcceptedAt  time.Time  `json:"acceptedAt"`
+	CompletedAt *time.Time `json:"completedAt,omitempty"`
+}
+
+// DeliveryTracker keeps the status of the async sends in memory
+// Finished deliveries are forgotten after DeliveryRetention
+type DeliveryTracker struct {
+	mu         sync.Mutex
+	deliveries map[string]*Delivery
+	finished   []finishedDelivery // In completion order, to expire the oldest first
+}
+
+type finishedDelivery struct {
+	id         string
+	finishedAt time.Time
+}
+
+// NewDeliveryTracker creates an empty delivery tracker
+func NewDeliveryTracker() *DeliveryTracker {
+	return &DeliveryTracker{deliveries: make(map[string]*Delivery)}
+}
+
+// track registers a pending delivery
+func (t *DeliveryTracker) track(id string) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(now)
+	t.deliveries[id] = &Delivery{ID: id, Status: DeliveryPending, AcceptedAt: now.UTC()}
+}
+
+// acknowledge records that Kafka stored the message at partition and offset
+func (t *DeliveryTracker) acknowledge(id string, partition int32, offset int64) {
+	t.finish(id, func(delivery *Delivery) {
+		delivery.Status = DeliveryAcknowledged
+		delivery.Partition = &partition
+		delivery.Offset = &offset
+	})
+}
+
+// fail records that the message could not be delivered
+func (t *DeliveryTracker) fail(id string, err error) {
+	t.finish(id, func(delivery *Delivery) {
+		delivery.Status = DeliveryFailed
+		delivery.Error = err.Error()
+	})
+}
+
+// finish applies the final outcome of a delivery
+func (t *DeliveryTracker) finish(id string, outcome func(delivery *Delivery)) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delivery, ok := t.deliveries[id]
+	if !ok {
+		return
+	}
+	outcome(delivery)
+	completedAt := now.UTC()
+	delivery.CompletedAt = &completedAt
+	t.finished = append(t.finished, finishedDelivery{id: id, finishedAt: now})
+}
+
+// Get returns a snapshot of the delivery
+func (t *DeliveryTracker) Get(id string) (Delivery, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delivery, ok := t.deliveries[id]
+	if !ok {
+		return Delivery{}, ErrDeliveryNotFound
+	}
+	return *delivery, nil
+}
+
+// expire forgets the deliveries that finished more than DeliveryRetention ago
+// Must be called with the lock held
+func (t *DeliveryTracker) expire(now time.Time) {
+	i := 0
+	for i < len(t.finished) && now.Sub(t.finished[i].finishedAt) > DeliveryRetention {
+		delete(t.deliveries, t.finished[i].id)
+		i++
+	}
+	if i > 0 {
+		// Copy the survivors so the dropped entries can be garbage collected
+		t.finished = append([]finishedDelivery(nil), t.finished[i:]...)
+	}
+}
@@ -0,0 +1,289 @@
+package producer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"kafka-notify/pkg/directory"
+	"kafka-notify/pkg/models"
+
+	"github.com/IBM/sarama"
+	"github.com/alejoacosta74/go-logger"
+)
+
+// Broadcast job statuses
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusCancelled = "cancelled"
+)
+
+const (
+	// fanoutChunkSize is how many recipients are published with each SendMessages call
+	fanoutChunkSize = MaxBatchSize
+	// maxJobErrors bounds the per-recipient errors kept on a job
+	maxJobErrors = 20
+	// JobRetention is how long finished jobs can still be queried
+	JobRetention = time.Hour
+)
+
+var (
+	// ErrJobNotFound is returned when a broadcast job does not exist or has expired
+	ErrJobNotFound = errors.New("broadcast job not found")
+	// ErrNoRecipients is returned when a broadcast target expands to nobody
+	ErrNoRecipients = errors.New("broadcast has no recipients")
+	// ErrInvalidTarget is returned when a broadcast does not name exactly one target
+	ErrInvalidTarget = errors.New("broadcast must target either recipients, a group or all users")
+)
+
+// BroadcastRequest is the JSON body of a fan-out send
+// Exactly one of ToIDs, Group and All selects the recipients, the sender never notifies itself
+type BroadcastRequest struct {
+	FromID         int               `json:"fromID" binding:"required"`
+	ToIDs          []int             `json:"toIDs"`
+	Group          string            `json:"group"`
+	All            bool              `json:"all"`
+	Message        string            `json:"message" binding:"required,max=4096"`
+	Kind           string            `json:"kind"`
+	IdempotencyKey string            `json:"idempotencyKey" binding:"max=256"`
+	Metadata       map[string]string `json:"metadata"`
+	// CorrelationID comes from the X-Correlation-ID or X-Request-ID header of the HTTP request
+	CorrelationID string `json:"-"`
+}
+
+// RecipientError reports a recipient that could not be notified
+type RecipientError struct {
+	ToID  int    `json:"toID"`
+	Error string `json:"error"`
+}
+
+// BroadcastJob tracks the progress of a fan-out
+type BroadcastJob struct {
+	ID         string           `json:"id"`
+	Status     string           `json:"status"`
+	Total      int              `json:"total"`
+	Sent       int              `json:"sent"`
+	Failed     int              `json:"failed"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	FinishedAt *time.Time       `json:"finishedAt,omitempty"`
+	Error      string           `json:"error,omitempty"`
+	Errors     []RecipientError `json:"errors,omitempty"` // First maxJobErrors failures
+}
+
+// JobTracker keeps the broadcast jobs in memory
+// Finished jobs are forgotten after JobRetention
+type JobTracker struct {
+	mu      sync.Mutex
+	jobs    map[string]*BroadcastJob
+	running sync.WaitGroup // Broadcasts still publishing
+}
+
+// NewJobTracker creates an empty job tracker
+func NewJobTracker() *JobTracker {
+	return &JobTracker{jobs: make(map[string]*BroadcastJob)}
+}
+
+// create registers a new pending job for total recipients
+func (t *JobTracker) create(total int) *BroadcastJob {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.expire(time.Now())
+	job := &BroadcastJob{
+		ID:        models.NewID(),
+		Status:    JobStatusPending,
+		Total:     total,
+		CreatedAt: time.Now().UTC(),
+	}
+	t.jobs[job.ID] = job
+	return job
+}
+
+// Get returns a snapshot of the job
+func (t *JobTracker) Get(id string) (BroadcastJob, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	job, ok := t.jobs[id]
+	if !ok {
+		return BroadcastJob{}, ErrJobNotFound
+	}
+	snapshot := *job
+	snapshot.Errors = append([]RecipientError(nil), job.Errors...)
+	return snapshot, nil
+}
+
+// Wait blocks until every running broadcast stopped publishing
+func (t *JobTracker) Wait() {
+	t.running.Wait()
+}
+
+// update applies a change to the job while holding the lock
+func (t *JobTracker) update(id string, change func(job *BroadcastJob)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if job, ok := t.jobs[id]; ok {
+		change(job)
+	}
+}
+
+// expire forgets the jobs that finished more than JobRetention ago
+// Must be called with the lock held
+func (t *JobTracker) expire(now time.Time) {
+	for id, job := range t.jobs {
+		if job.FinishedAt != nil && now.Sub(*job.FinishedAt) > JobRetention {
+			delete(t.jobs, id)
+		}
+	}
+}
+
+// resolveRecipients expands the broadcast target into the recipient IDs,
+// sorted, without duplicates and without the sender
+func resolveRecipients(req BroadcastRequest, users directory.UserDirectory) ([]int, error) {
+	targets := 0
+	if len(req.ToIDs) > 0 {
+		targets++
+	}
+	if req.Group != "" {
+		targets++
+	}
+	if req.All {
+		targets++
+	}
+	if targets != 1 {
+		return nil, ErrInvalidTarget
+	}
+
+	var ids []int
+	switch {
+	case req.All:
+		all, err := users.List()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list users: %w", err)
+		}
+		for _, user := range all {
+			if !user.Deactivated {
+				ids = append(ids, user.ID)
+			}
+		}
+	case req.Group != "":
+		members, err := users.Group(req.Group)
+		if err != nil {
+			return nil, err
+		}
+		ids = members
+	default:
+		ids = req.ToIDs
+	}
+
+	seen := make(map[int]bool, len(ids))
+	recipients := make([]int, 0, len(ids))
+	for _, id := range ids {
+		if id == req.FromID || seen[id] {
+			continue
+		}
+		seen[id] = true
+		recipients = append(recipients, id)
+	}
+	if len(recipients) == 0 {
+		return nil, ErrNoRecipients
+	}
+	sort.Ints(recipients)
+	return recipients, nil
+}
+
+// startBroadcast validates the broadcast and starts publishing it in the background
+// Returns the job tracking its progress
+func startBroadcast(ctx context.Context, producer sarama.SyncProducer, users directory.UserDirectory,
+	jobs *JobTracker, req BroadcastRequest) (BroadcastJob, error) {
+	recipients, err := resolveRecipients(req, users)
+	if err != nil {
+		return BroadcastJob{}, err
+	}
+	// Validate the sender and kind up front, recipients are checked one by one
+	if _, err := models.ParseKind(req.Kind); err != nil {
+		return BroadcastJob{}, err
+	}
+	if _, err := findActiveUser(req.FromID, users); err != nil {
+		return BroadcastJob{}, err
+	}
+
+	job := jobs.create(len(recipients))
+	logger.Info("Broadcast job created", "job", job.ID, "recipients", len(recipients))
+	jobs.running.Add(1)
+	go func() {
+		defer jobs.running.Done()
+		runBroadcast(ctx, producer, users, jobs, job.ID, req, recipients)
+	}()
+	return jobs.Get(job.ID)
+}
+
+// runBroadcast publishes one message per recipient, keyed by recipient ID,
+// in chunks of fanoutChunkSize and records the progress on the job
+// Stops before the next send when the context is cancelled
+func runBroadcast(ctx context.Context, producer sarama.SyncProducer, users directory.UserDirectory,
+	jobs *JobTracker, jobID string, req BroadcastRequest, recipients []int) {
+	jobs.update(jobID, func(job *BroadcastJob) { job.Status = JobStatusRunning })
+
+	for start := 0; start < len(recipients); start += fanoutChunkSize {
+		end := min(start+fanoutChunkSize, len(recipients))
+
+		reqs := make([]SendRequest, 0, end-start)
+		for _, toID := range recipients[start:end] {
+			reqs = append(reqs, SendRequest{
+				FromID:         req.FromID,
+				ToID:           toID,
+				Message:        req.Message,
+				Kind:           req.Kind,
+				IdempotencyKey: req.IdempotencyKey,
+				Metadata:       req.Metadata,
+				CorrelationID:  req.CorrelationID,
+			})
+		}
+		if ctx.Err() != nil {
+			finishJob(jobs, jobID, JobStatusCancelled, "producer shutting down")
+			logger.Warn("Broadcast job cancelled", "job", jobID)
+			return
+		}
+		results := sendKafkaProducerBatch(producer, users, reqs)
+
+		jobs.update(jobID, func(job *BroadcastJob) {
+			for _, result := range results {
+				if result.Status == BatchStatusSent {
+					job.Sent++
+					continue
+				}
+				job.Failed++
+				if len(job.Errors) < maxJobErrors {
+					job.Errors = append(job.Errors, RecipientError{
+						ToID:  reqs[result.Index].ToID,
+						Error: result.Error,
+					})
+				}
+			}
+		})
+	}
+
+	status := JobStatusCompleted
+	snapshot, _ := jobs.Get(jobID)
+	if snapshot.Sent == 0 {
+		status = JobStatusFailed
+	}
+	finishJob(jobs, jobID, status, "")
+	logger.Info("Broadcast job finished", "job", jobID, "status", status,
+		"sent", snapshot.Sent, "failed", snapshot.Failed)
+}
+
+// finishJob records the final status of a job
+func finishJob(jobs *JobTracker, jobID, status, reason string) {
+	jobs.update(jobID, func(job *BroadcastJob) {
+		now := time.Now().UTC()
+		job.Status = status
+		job.Error = reason
+		job.FinishedAt = &now
+	})
+}
@@ -0,0 +1,60 @@
+package producer
+
+import (
+	"context"
+	"testing"
+
+	"kafka-notify/pkg/directory"
+	"kafka-notify/pkg/models"
+
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestDirectory returns a directory with users 1, 2 and 3
+func newTestDirectory() directory.UserDirectory {
+	return directory.NewMemoryDirectory([]models.User{
+		{ID: 1, Name: "Micho"},
+		{ID: 2, Name: "Tito"},
+		{ID: 3, Name: "Lola"},
+	}, nil)
+}
+
+func TestBroadcastWaitCoversRunningJobs(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+	jobs := NewJobTracker()
+
+	job, err := startBroadcast(context.Background(), producer, newTestDirectory(), jobs,
+		BroadcastRequest{FromID: 1, All: true, Message: "hello"})
+	require.NoError(t, err)
+	jobs.Wait()
+	// Closing verifies every expected send happened, none may happen after it
+	require.NoError(t, producer.Close())
+
+	finished, err := jobs.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusCompleted, finished.Status)
+	assert.Equal(t, 2, finished.Sent)
+}
+
+func TestBroadcastCancelledBeforeSend(t *testing.T) {
+	// No send is expected: the mock fails the test if the broadcast publishes
+	producer := mocks.NewSyncProducer(t, nil)
+	jobs := NewJobTracker()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	job, err := startBroadcast(ctx, producer, newTestDirectory(), jobs,
+		BroadcastRequest{FromID: 1, ToIDs: []int{2, 3}, Message: "hello"})
+	require.NoError(t, err)
+	jobs.Wait()
+	require.NoError(t, producer.Close())
+
+	finished, err := jobs.Get(job.ID)
+	require.NoError(t, err)
+	assert.Equal(t, JobStatusCancelled, finished.Status)
+	assert.Zero(t, finished.Sent)
+}
@@ -2,16 +2,34 @@ package producer
 
 import (
 	"errors"
+	"fmt"
+	"kafka-notify/pkg/directory"
 	"kafka-notify/pkg/models"
 )
 
 var ErrUserNotFoundInProducer = errors.New("user not found")
 
-func findUserByID(id int, users []models.User) (models.User, error) {
-	for _, user := range users {
-		if user.ID == id {
-			return user, nil
-		}
+// ErrUserDeactivated is returned when a notification is sent to or from a deactivated user
+var ErrUserDeactivated = errors.New("user deactivated")
+
+// findUserByID looks the user up in the directory
+// Unknown users are reported as ErrUserNotFoundInProducer, directory failures are returned as is
+func findUserByID(id int, users directory.UserDirectory) (models.User, error) {
+	user, err := users.Lookup(id)
+	if errors.Is(err, directory.ErrUserNotFound) {
+		return models.User{}, fmt.Errorf("%w: %d", ErrUserNotFoundInProducer, id)
+	}
+	return user, err
+}
+
+// findActiveUser looks the user up in the directory and rejects deactivated users
+func findActiveUser(id int, users directory.UserDirectory) (models.User, error) {
+	user, err := findUserByID(id, users)
+	if err != nil {
+		return models.User{}, err
+	}
+	if user.Deactivated {
+		return models.User{}, fmt.Errorf("%w: %d", ErrUserDeactivated, id)
 	}
-	return models.User{}, ErrUserNotFoundInProducer
+	return user, nil
 }
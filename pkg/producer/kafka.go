@@ -3,21 +3,60 @@ package producer
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"kafka-notify/pkg/directory"
+	"kafka-notify/pkg/metrics"
 	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/outbox"
+	"os"
 	"strconv"
+	"time"
 
 	"github.com/IBM/sarama"
 	"github.com/alejoacosta74/go-logger"
-	"github.com/gin-gonic/gin"
 )
 
-// setupProducer initializes and configures a Kafka producer for synchronous message sending
-func setupProducer(ctx context.Context) (sarama.SyncProducer, error) {
+// producerHost is sent in the producer-host header of every message
+var producerHost, _ = os.Hostname()
+
+// DeliveryOptions configures the delivery guarantees of the Kafka producers
+type DeliveryOptions struct {
+	// Idempotent makes the broker drop the duplicates created by producer retries
+	Idempotent bool
+	// MaxInFlight is the number of unacknowledged requests per broker connection,
+	// 0 keeps the sarama default. The idempotent producer needs 1
+	MaxInFlight int
+	// TransactionalID enables the transactional producer used by /send/transactional
+	TransactionalID string
+}
+
+// newProducerConfig creates the sarama configuration shared by the producers
+func newProducerConfig(options DeliveryOptions) *sarama.Config {
 	// Create a new Kafka configuration with default settings
 	config := sarama.NewConfig()
 	// Enable producer acknowledgments so we can confirm messages were sent successfully
 	config.Producer.Return.Successes = true
+	if options.MaxInFlight > 0 {
+		config.Net.MaxOpenRequests = options.MaxInFlight
+	}
+	if options.Idempotent {
+		// Sequence numbers are only reliable when every replica acknowledged
+		// and requests cannot be reordered
+		config.Producer.Idempotent = true
+		config.Producer.RequiredAcks = sarama.WaitForAll
+		if options.MaxInFlight == 0 {
+			config.Net.MaxOpenRequests = 1
+		}
+	}
+	return config
+}
+
+// setupProducer initializes and configures a Kafka producer for synchronous message sending
+// It is closed by the caller once the scheduler and the broadcasts publishing with it
+// stopped, not on context cancellation: sending on a closed producer panics
+func setupProducer(options DeliveryOptions) (sarama.SyncProducer, error) {
+	config := newProducerConfig(options)
 	// Create a new synchronous producer connected to our Kafka broker
 	producer, err := sarama.NewSyncProducer([]string{KafkaServerAddress}, config)
 	// If producer creation fails, wrap the error with additional context
@@ -25,67 +64,378 @@ func setupProducer(ctx context.Context) (sarama.SyncProducer, error) {
 		logger.Error("Failed to setup producer", "error", err)
 		return nil, fmt.Errorf("failed to setup producer: %w", err)
 	}
-	logger.Info("New kafka producer created")
-	// Return the successfully created producer
+	logger.Info("New kafka producer created", "idempotent", options.Idempotent)
+	// Return the successfully created producer, timing every send
+	return metrics.InstrumentSyncProducer(producer), nil
+}
+
+// setupRelayProducer initializes the producer the outbox relay publishes with
+// It is closed by the caller once the relay stopped, not on context cancellation
+func setupRelayProducer(options DeliveryOptions) (sarama.SyncProducer, error) {
+	config := newProducerConfig(options)
+	// The relay retries on its own schedule, fail fast when the broker is down
+	config.Producer.Retry.Max = 1
+	producer, err := sarama.NewSyncProducer([]string{KafkaServerAddress}, config)
+	if err != nil {
+		logger.Error("Failed to setup outbox relay producer", "error", err)
+		return nil, fmt.Errorf("failed to setup outbox relay producer: %w", err)
+	}
+	logger.Info("New kafka outbox relay producer created")
+	return metrics.InstrumentSyncProducer(producer), nil
+}
+
+// setupTransactionalProducer initializes the producer used for transactional sends
+// Transactions always use the idempotent producer with acks from every in-sync replica
+func setupTransactionalProducer(ctx context.Context, options DeliveryOptions) (sarama.SyncProducer, error) {
+	options.Idempotent = true
+	config := newProducerConfig(options)
+	config.Producer.Transaction.ID = options.TransactionalID
+	producer, err := sarama.NewSyncProducer([]string{KafkaServerAddress}, config)
+	if err != nil {
+		logger.Error("Failed to setup transactional producer", "error", err)
+		return nil, fmt.Errorf("failed to setup transactional producer: %w", err)
+	}
+	logger.Info("New kafka transactional producer created", "transactionalID", options.TransactionalID)
+
+	go func() {
+		<-ctx.Done()
+		producer.Close()
+		logger.Warn("Kafka transactional producer closed")
+	}()
+
+	// Messages of aborted transactions are counted as failed
+	return metrics.InstrumentSyncProducer(producer), nil
+}
+
+// setupAsyncProducer initializes a Kafka producer that queues messages without waiting for the broker
+// The outcome of every message is recorded in deliveries by background goroutines
+func setupAsyncProducer(ctx context.Context, options DeliveryOptions,
+	deliveries *DeliveryTracker) (sarama.AsyncProducer, error) {
+	config := newProducerConfig(options)
+	// Report both acknowledgments and failures so every delivery gets a final status
+	config.Producer.Return.Errors = true
+	producer, err := sarama.NewAsyncProducer([]string{KafkaServerAddress}, config)
+	if err != nil {
+		logger.Error("Failed to setup async producer", "error", err)
+		return nil, fmt.Errorf("failed to setup async producer: %w", err)
+	}
+	logger.Info("New kafka async producer created")
 
-	// Monitor context for shutting down the producer
+	// Drain the result channels until the producer is closed, a full channel would block the producer
+	go func() {
+		for msg := range producer.Successes() {
+			queued, _ := msg.Metadata.(asyncMessage)
+			deliveries.acknowledge(queued.id, msg.Partition, msg.Offset)
+			metrics.ProduceDuration.WithLabelValues(msg.Topic).Observe(time.Since(queued.queuedAt).Seconds())
+			logger.Info("Message acknowledged by Kafka", "id", queued.id, "partition", msg.Partition, "offset", msg.Offset)
+		}
+	}()
+	go func() {
+		for producerErr := range producer.Errors() {
+			queued, _ := producerErr.Msg.Metadata.(asyncMessage)
+			deliveries.fail(queued.id, producerErr.Err)
+			metrics.ProduceDuration.WithLabelValues(producerErr.Msg.Topic).Observe(time.Since(queued.queuedAt).Seconds())
+			metrics.ProduceErrors.WithLabelValues(producerErr.Msg.Topic).Inc()
+			logger.Error("Failed to deliver message to Kafka", "id", queued.id, "error", producerErr.Err)
+		}
+	}()
+
+	// Monitor context for shutting down the producer, pending messages are flushed on close
 	go func() {
 		<-ctx.Done()
 		producer.Close()
-		logger.Warn("Kafka producer closed")
+		logger.Warn("Kafka async producer closed")
 	}()
 
 	return producer, nil
 }
 
 // sendKafkaProducerMessage sends a notification message to Kafka from one user to another
+// Returns the notification that was sent, including its generated ID
 func sendKafkaProducerMessage(producer sarama.SyncProducer,
-	users []models.User, ctx *gin.Context, fromID, toID int) error {
-	// Get the message content from the HTTP form data
-	message := ctx.PostForm("message")
+	users directory.UserDirectory, req SendRequest) (models.Notification, error) {
+	// Build the notification from the request, validating its users and kind
+	notification, err := buildNotification(users, req)
+	if err != nil {
+		return models.Notification{}, err
+	}
+	if err := publishNotification(producer, notification); err != nil {
+		return models.Notification{}, err
+	}
+	return notification, nil
+}
+
+// publishNotification sends an already built notification to Kafka
+func publishNotification(producer sarama.SyncProducer, notification models.Notification) error {
+	// Create a Kafka producer message for the notification
+	msg, err := newProducerMessage(notification)
+	if err != nil {
+		return err
+	}
+
+	// Send the message to Kafka and return any error
+	partition, offset, err := producer.SendMessage(msg)
+	if err != nil {
+		logger.Error("Failed to send message to Kafka", "error", err)
+		return fmt.Errorf("failed to send message to Kafka: %w", err)
+	}
+
+	logger.Info("Message sent to Kafka", "id", notification.ID, "partition: ", partition, "offset: ", offset)
+	return nil
+}
+
+// asyncMessage identifies a message queued on the async producer in its results
+type asyncMessage struct {
+	id       string
+	queuedAt time.Time
+}
+
+// sendKafkaProducerMessageAsync queues a notification on the async producer and returns
+// without waiting for Kafka, the delivery is tracked under the notification ID
+func sendKafkaProducerMessageAsync(producer sarama.AsyncProducer, users directory.UserDirectory,
+	deliveries *DeliveryTracker, req SendRequest) (models.Notification, error) {
+	notification, err := buildNotification(users, req)
+	if err != nil {
+		return models.Notification{}, err
+	}
+	msg, err := newProducerMessage(notification)
+	if err != nil {
+		return models.Notification{}, err
+	}
+
+	// Metadata maps the acknowledgment or error back to the delivery
+	msg.Metadata = asyncMessage{id: notification.ID, queuedAt: time.Now()}
+	deliveries.track(notification.ID)
+	producer.Input() <- msg
+
+	logger.Info("Message queued for Kafka", "id", notification.ID)
+	return notification, nil
+}
+
+// enqueueNotification durably stores a notification in the outbox, the relay publishes it later
+func enqueueNotification(box *outbox.Outbox, users directory.UserDirectory,
+	req SendRequest) (models.Notification, error) {
+	notification, err := buildNotification(users, req)
+	if err != nil {
+		return models.Notification{}, err
+	}
+	if err := enqueue(box, notification); err != nil {
+		return models.Notification{}, err
+	}
+	return notification, nil
+}
+
+// enqueue writes an already built notification to the outbox
+func enqueue(box *outbox.Outbox, notification models.Notification) error {
+	msg, err := newProducerMessage(notification)
+	if err != nil {
+		return err
+	}
+	value, _ := msg.Value.Encode()
+	if _, err := box.Enqueue(notification.ID, msg.Topic, strconv.Itoa(notification.To.ID), value, msg.Headers); err != nil {
+		logger.Error("Failed to write notification to outbox", "error", err)
+		return err
+	}
+	logger.Info("Notification written to outbox", "id", notification.ID)
+	return nil
+}
+
+// buildNotification creates a notification with a unique ID from a send request
+func buildNotification(users directory.UserDirectory, req SendRequest) (models.Notification, error) {
+	// Get the notification kind, defaulting to a plain message
+	kind, err := models.ParseKind(req.Kind)
+	if err != nil {
+		logger.Error("Invalid notification kind", "error", err)
+		return models.Notification{}, err
+	}
 
 	// Find the sender user by their ID
-	fromUser, err := findUserByID(fromID, users)
+	fromUser, err := findActiveUser(req.FromID, users)
 	if err != nil {
 		logger.Error("Failed to find sender user", "error", err)
-		return err
+		return models.Notification{}, err
 	}
 
 	// Find the recipient user by their ID
-	toUser, err := findUserByID(toID, users)
+	toUser, err := findActiveUser(req.ToID, users)
 	if err != nil {
 		logger.Error("Failed to find recipient user", "error", err)
-		return err
+		return models.Notification{}, err
 	}
 
-	// Create a notification object with the sender, recipient and message
+	// Create a notification object with a unique ID, the sender, recipient and message
 	notification := models.Notification{
-		From:    fromUser,
-		To:      toUser,
-		Message: message,
+		ID:             models.NewID(),
+		IdempotencyKey: req.IdempotencyKey,
+		Kind:           kind,
+		From:           fromUser,
+		To:             toUser,
+		Message:        req.Message,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if len(req.Metadata) > 0 {
+		notification.Metadata = req.Metadata
 	}
+	if req.CorrelationID != "" {
+		notification.Trace = &models.Trace{CorrelationID: req.CorrelationID}
+	}
+	return notification, nil
+}
 
+// newProducerMessage encodes a notification as a Kafka message keyed by recipient ID,
+// so all the notifications of a user land in the same partition and keep their order
+// The trace travels in the message headers, not in the JSON value
+func newProducerMessage(notification models.Notification) (*sarama.ProducerMessage, error) {
+	headers := messageHeaders(notification, time.Now())
+	notification.Trace = nil
 	// Convert the notification struct to JSON bytes
 	notificationJSON, err := json.Marshal(notification)
 	if err != nil {
 		logger.Error("Failed to marshal notification", "error", err)
-		return fmt.Errorf("failed to marshal notification: %w", err)
+		return nil, fmt.Errorf("failed to marshal notification: %w", err)
 	}
 
-	// Create a Kafka producer message with the topic, recipient ID as key, and JSON as value
-	msg := &sarama.ProducerMessage{
-		Topic: KafkaTopic,
-		Key:   sarama.StringEncoder(strconv.Itoa(toUser.ID)),
-		Value: sarama.StringEncoder(notificationJSON),
+	// Create a Kafka producer message with the topic, recipient ID as key, JSON as value and the headers
+	return &sarama.ProducerMessage{
+		Topic:   KafkaTopic,
+		Key:     sarama.StringEncoder(strconv.Itoa(notification.To.ID)),
+		Value:   sarama.StringEncoder(notificationJSON),
+		Headers: headers,
+	}, nil
+}
+
+// messageHeaders returns the headers describing a notification produced at producedAt
+func messageHeaders(notification models.Notification, producedAt time.Time) []sarama.RecordHeader {
+	headers := []sarama.RecordHeader{
+		stringHeader(models.HeaderContentType, models.ContentTypeJSON),
+		stringHeader(models.HeaderSchemaVersion, models.SchemaVersion),
+		stringHeader(models.HeaderNotificationID, notification.ID),
+		stringHeader(models.HeaderProducedAt, producedAt.UTC().Format(time.RFC3339Nano)),
+	}
+	if producerHost != "" {
+		headers = append(headers, stringHeader(models.HeaderProducerHost, producerHost))
 	}
+	if notification.Trace != nil && notification.Trace.CorrelationID != "" {
+		headers = append(headers, stringHeader(models.HeaderCorrelationID, notification.Trace.CorrelationID))
+	}
+	return headers
+}
 
-	// Send the message to Kafka and return any error
-	partition, offset, err := producer.SendMessage(msg)
-	if err != nil {
-		logger.Error("Failed to send message to Kafka", "error", err)
-		return fmt.Errorf("failed to send message to Kafka: %w", err)
+// stringHeader builds a record header with a string value
+func stringHeader(key, value string) sarama.RecordHeader {
+	return sarama.RecordHeader{Key: []byte(key), Value: []byte(value)}
+}
+
+// sendKafkaProducerBatch publishes many notifications with a single SendMessages call
+// Returns one result per request, in the same order
+func sendKafkaProducerBatch(producer sarama.SyncProducer,
+	users directory.UserDirectory, reqs []SendRequest) []BatchResult {
+	results := make([]BatchResult, len(reqs))
+	messages := make([]*sarama.ProducerMessage, 0, len(reqs))
+
+	for i, req := range reqs {
+		results[i].Index = i
+		// Reject invalid items individually so the rest of the batch is still sent
+		notification, ok := buildBatchNotification(users, req, &results[i])
+		if !ok {
+			continue
+		}
+		msg, err := newProducerMessage(notification)
+		if err != nil {
+			results[i].Status = BatchStatusInvalid
+			results[i].Error = err.Error()
+			continue
+		}
+		// Metadata maps the message back to its request once sent
+		msg.Metadata = i
+		messages = append(messages, msg)
+		results[i].ID = notification.ID
 	}
 
-	logger.Info("Message sent to Kafka", "partition: ", partition, "offset: ", offset)
-	return nil
+	if len(messages) == 0 {
+		return results
+	}
+
+	// Failed messages are reported in ProducerErrors, the rest were acknowledged
+	failed := make(map[int]error)
+	if err := producer.SendMessages(messages); err != nil {
+		var producerErrors sarama.ProducerErrors
+		if errors.As(err, &producerErrors) {
+			for _, producerErr := range producerErrors {
+				failed[producerErr.Msg.Metadata.(int)] = producerErr.Err
+			}
+		} else {
+			for _, msg := range messages {
+				failed[msg.Metadata.(int)] = err
+			}
+		}
+		logger.Error("Failed to send batch to Kafka", "failed", len(failed), "error", err)
+	}
+
+	for _, msg := range messages {
+		i := msg.Metadata.(int)
+		if err, ok := failed[i]; ok {
+			results[i].Status = BatchStatusFailed
+			results[i].Error = err.Error()
+			continue
+		}
+		partition, offset := msg.Partition, msg.Offset
+		results[i].Status = BatchStatusSent
+		results[i].Partition = &partition
+		results[i].Offset = &offset
+	}
+	logger.Info("Batch sent to Kafka", "messages", len(messages), "failed", len(failed))
+	return results
+}
+
+// enqueueBatch writes many notifications to the outbox, the relay publishes them later
+// Returns one result per request, in the same order
+func enqueueBatch(box *outbox.Outbox, users directory.UserDirectory, reqs []SendRequest) []BatchResult {
+	results := make([]BatchResult, len(reqs))
+	accepted := 0
+	for i, req := range reqs {
+		results[i].Index = i
+		notification, ok := buildBatchNotification(users, req, &results[i])
+		if !ok {
+			continue
+		}
+		results[i].ID = notification.ID
+		if err := enqueue(box, notification); err != nil {
+			results[i].Status = BatchStatusFailed
+			results[i].Error = err.Error()
+			continue
+		}
+		results[i].Status = BatchStatusAccepted
+		accepted++
+	}
+	logger.Info("Batch written to outbox", "accepted", accepted, "failed", len(reqs)-accepted)
+	return results
+}
+
+// buildBatchNotification validates a batch item and creates its notification
+// Returns false with result reporting why when the item is invalid
+func buildBatchNotification(users directory.UserDirectory, req SendRequest,
+	result *BatchResult) (models.Notification, bool) {
+	if err := validateSendRequest(req); err != nil {
+		result.Status = BatchStatusInvalid
+		result.Error = "invalid notification"
+		result.Errors = fieldErrors(nil, err)
+		return models.Notification{}, false
+	}
+	if req.DeliverAt != nil {
+		result.Status = BatchStatusInvalid
+		result.Error = "invalid notification"
+		result.Errors = map[string]string{"deliver_at": "is not supported by batch sends, use /send"}
+		return models.Notification{}, false
+	}
+	notification, err := buildNotification(users, req)
+	if err != nil {
+		result.Status = BatchStatusInvalid
+		result.Error = err.Error()
+		if errors.Is(err, models.ErrInvalidKind) {
+			result.Errors = map[string]string{"kind": err.Error()}
+		}
+		return models.Notification{}, false
+	}
+	return notification, true
 }
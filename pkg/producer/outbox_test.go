@@ -0,0 +1,53 @@
+package producer
+
+import (
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"kafka-notify/pkg/outbox"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBatchSendWritesToOutbox(t *testing.T) {
+	box, err := outbox.Open(filepath.Join(t.TempDir(), "outbox.db"))
+	require.NoError(t, err)
+	defer box.Close()
+	users := newTestDirectory()
+	// No producer at all: the batch must not need the broker
+	handler := sendBatchHandler(func(reqs []SendRequest) []BatchResult {
+		return enqueueBatch(box, users, reqs)
+	}, nil)
+
+	w := postJSON(handler, `{"notifications": [
+		{"fromID": 1, "toID": 2, "message": "a"},
+		{"fromID": 1, "toID": 3, "message": "b"}]}`)
+	assert.Equal(t, http.StatusAccepted, w.Code)
+	var response struct {
+		Accepted int           `json:"accepted"`
+		Results  []BatchResult `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Accepted)
+	require.Len(t, response.Results, 2)
+	entries, err := box.List(0, 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for i, result := range response.Results {
+		assert.Equal(t, BatchStatusAccepted, result.Status)
+		assert.Equal(t, result.ID, entries[i].ID)
+	}
+	assert.Equal(t, "3", entries[1].Key)
+
+	// Invalid items are reported without being written
+	w = postJSON(handler, `{"notifications": [
+		{"fromID": 1, "toID": 2, "message": "a"},
+		{"fromID": 1, "toID": 99, "message": "b"}]}`)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, BatchStatusInvalid, response.Results[1].Status)
+	assert.Equal(t, 3, box.Depth())
+}
@@ -2,7 +2,12 @@ package producer
 
 import (
 	"context"
+	"kafka-notify/pkg/directory"
+	"kafka-notify/pkg/metrics"
 	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/outbox"
+	"kafka-notify/pkg/ratelimit"
+	"kafka-notify/pkg/scheduler"
 	"kafka-notify/pkg/server"
 	"time"
 
@@ -22,38 +27,176 @@ func Run() {
 	// Create cancellable context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	users := []models.User{
-		{ID: 1, Name: "Micho"},
-		{ID: 2, Name: "Tito"},
-		{ID: 3, Name: "Negro"},
-		{ID: 4, Name: "Cabezon"},
+	// Open the directory the senders and recipients are looked up in
+	users, err := directory.Open(directory.Config{
+		Backend:  viper.GetString("users"),
+		Source:   viper.GetString("users-source"),
+		CacheTTL: viper.GetDuration("users-cache-ttl"),
+	})
+	if err != nil {
+		logger.Fatal("Failed to open user directory", "error", err)
+	}
+	defer users.Close()
+
+	// Rate limit /send per sender, recipient and globally when limits are configured
+	var limiter *RateLimiter
+	if limitsPath := viper.GetString("rate-limits"); limitsPath != "" {
+		limits, err := LoadRateLimits(limitsPath)
+		if err != nil {
+			logger.Fatal("Failed to load rate limits", "error", err)
+		}
+		buckets, err := ratelimit.Open(ratelimit.Config{
+			Backend: viper.GetString("rate-limiter"),
+			Source:  viper.GetString("rate-limiter-source"),
+		})
+		if err != nil {
+			logger.Fatal("Failed to open rate limiter", "error", err)
+		}
+		defer buckets.Close()
+		limiter = NewRateLimiter(buckets, limits)
 	}
 
-	producer, err := setupProducer(ctx)
+	// Track the progress of broadcast jobs
+	jobs := NewJobTracker()
+
+	options := DeliveryOptions{
+		Idempotent:      viper.GetBool("idempotent"),
+		MaxInFlight:     viper.GetInt("max-in-flight"),
+		TransactionalID: viper.GetString("transactional-id"),
+	}
+	producer, err := setupProducer(options)
 	if err != nil {
 		logger.Fatal("Failed to initialize producer", "error", err)
 	}
-	defer producer.Close()
+	defer func() {
+		producer.Close()
+		logger.Warn("Kafka producer closed")
+	}()
+
+	// Transactional sends need their own producer, every send of a transactional
+	// producer must happen inside a transaction
+	var transactions *TransactionalSender
+	if options.TransactionalID != "" {
+		transactionalProducer, err := setupTransactionalProducer(ctx, options)
+		if err != nil {
+			logger.Fatal("Failed to initialize transactional producer", "error", err)
+		}
+		transactions = NewTransactionalSender(transactionalProducer)
+	}
 
 	// gin.SetMode(gin.ReleaseMode)
 	// router := gin.Default()
 	// router.POST("/send", sendMessageHandler(producer, users))
 
+	// Write /send notifications to a durable outbox first when configured, so they
+	// survive broker outages; a relay publishes them in the background
+	var box *outbox.Outbox
+	if outboxPath := viper.GetString("outbox-path"); outboxPath != "" {
+		if viper.GetBool("async") {
+			logger.Fatal("The outbox and the async producer cannot be combined")
+		}
+		if box, err = outbox.Open(outboxPath); err != nil {
+			logger.Fatal("Failed to open outbox", "error", err)
+		}
+		defer box.Close()
+		metrics.RegisterOutbox(box)
+	}
+
+	// Hold notifications sent with a deliver_at until they are due, then publish
+	// them through the outbox when there is one, directly otherwise
+	deliver := func(notification models.Notification) error {
+		return publishNotification(producer, notification)
+	}
+	if box != nil {
+		deliver = func(notification models.Notification) error {
+			return enqueue(box, notification)
+		}
+	}
+	sched, err := scheduler.Open(viper.GetString("scheduler-path"), newSchedulerPublisher(users, deliver))
+	if err != nil {
+		logger.Fatal("Failed to open scheduler", "error", err)
+	}
+	defer sched.Close()
+	schedulerDone := make(chan struct{})
+	go func() {
+		sched.Run(ctx)
+		close(schedulerDone)
+	}()
+
 	// create and start http server to expose the consumer endpoint
 	httpServer := server.NewServer(ProducerPort)
-	httpServer.Post("/send", sendMessageHandler(producer, users))
+	// Attach the caller's correlation ID to the notifications, it is sent as a Kafka header
+	httpServer.Use(correlationMiddleware())
+	// Batch sends go through the outbox too when there is one
+	sendBatch := func(reqs []SendRequest) []BatchResult {
+		return sendKafkaProducerBatch(producer, users, reqs)
+	}
+	var relayDone chan struct{}
+	if box != nil {
+		sendBatch = func(reqs []SendRequest) []BatchResult {
+			return enqueueBatch(box, users, reqs)
+		}
+		relayProducer, err := setupRelayProducer(options)
+		if err != nil {
+			logger.Fatal("Failed to initialize outbox relay producer", "error", err)
+		}
+		defer relayProducer.Close()
+
+		relay := outbox.NewRelay(box, relayProducer)
+		relayDone = make(chan struct{})
+		go func() {
+			relay.Run(ctx)
+			close(relayDone)
+		}()
+		httpServer.Post("/send", sendOutboxHandler(box, users, sched, limiter))
+		httpServer.Get("/admin/outbox", outboxHandler(box, relay))
+	} else if viper.GetBool("async") {
+		// Queue /send notifications and report their delivery at /send/:id/status
+		deliveries := NewDeliveryTracker()
+		asyncProducer, err := setupAsyncProducer(ctx, options, deliveries)
+		if err != nil {
+			logger.Fatal("Failed to initialize async producer", "error", err)
+		}
+		httpServer.Post("/send", sendAsyncHandler(asyncProducer, users, deliveries, sched, limiter))
+		httpServer.Get("/send/:id/status", sendStatusHandler(deliveries))
+	} else {
+		httpServer.Post("/send", sendMessageHandler(producer, users, sched, limiter))
+	}
+	httpServer.Post("/send/batch", sendBatchHandler(sendBatch, limiter))
+	httpServer.Get("/scheduled", listScheduledHandler(sched))
+	httpServer.Get("/scheduled/:id", getScheduledHandler(sched))
+	httpServer.Put("/scheduled/:id", rescheduleHandler(sched))
+	httpServer.Delete("/scheduled/:id", cancelScheduledHandler(sched))
+	httpServer.Post("/send/transactional", sendTransactionalHandler(transactions, users, limiter))
+	httpServer.Post("/broadcast", broadcastHandler(ctx, producer, users, jobs, limiter))
+	httpServer.Get("/broadcast/:jobID", broadcastStatusHandler(jobs))
+	httpServer.Get("/admin/users", listUsersHandler(users))
+	httpServer.Post("/admin/users", createUserHandler(users))
+	httpServer.Put("/admin/users/:userID", updateUserHandler(users))
+	httpServer.Post("/admin/users/:userID/deactivate", deactivateUserHandler(users))
 	httpServer.ListenAndServe()
 
 	logger.Infof("Kafka PRODUCER 📨 started at http://localhost:%v", ProducerPort)
 
 	interruptCh := server.NewInterruptSignalChannel()
 	<-interruptCh
-	cancel()
 
-	ctxWithTimeout, _ := context.WithTimeout(ctx, 5*time.Second)
+	// Drain the requests in flight before cancelling the context, it closes the async
+	// and transactional producers the /send handlers publish with
+	ctxWithTimeout, cancelTimeout := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelTimeout()
 	httpServer.Shutdown(ctxWithTimeout)
+	cancel()
+	// Let the scheduler finish its current publish before closing the scheduler database
+	// and the producer, both are closed by the deferred calls once Run returns
+	<-schedulerDone
+	// Running broadcasts publish with the same producer, they stop before their next send
+	jobs.Wait()
+	if relayDone != nil {
+		// Let the relay finish its current publish before closing its producer and the outbox
+		<-relayDone
+	}
 
-	<-ctx.Done()
 	logger.Info("Kafka producer finished")
 
 }
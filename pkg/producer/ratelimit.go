@@ -0,0 +1,280 @@
+package producer
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/ratelimit"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// RatePolicy holds the limits of a notification kind, nil limits fall back to the default policy
+type RatePolicy struct {
+	Sender    *ratelimit.Limit `json:"sender" yaml:"sender"`       // Per fromID
+	Recipient *ratelimit.Limit `json:"recipient" yaml:"recipient"` // Per toID
+	Global    *ratelimit.Limit `json:"global" yaml:"global"`       // Across every user
+}
+
+// RateLimits are the /send rate limits, read from a JSON or YAML file:
+//
+//	default:
+//	  sender: {rate: 1, burst: 10}
+//	  recipient: {rate: 2, burst: 20}
+//	  global: {rate: 500, burst: 1000}
+//	kinds:
+//	  like:
+//	    sender: {rate: 5, burst: 50}
+//
+// Rates are tokens per second. A kind with its own limit gets its own buckets,
+// the kinds using the default limit share theirs
+type RateLimits struct {
+	Default RatePolicy                 `json:"default" yaml:"default"`
+	Kinds   map[models.Kind]RatePolicy `json:"kinds" yaml:"kinds"`
+}
+
+// LoadRateLimits reads and validates a rate limits file
+// The format is chosen by extension: .yaml and .yml are YAML, anything else is JSON
+func LoadRateLimits(path string) (RateLimits, error) {
+	var limits RateLimits
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return limits, fmt.Errorf("failed to read rate limits %s: %w", path, err)
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &limits)
+	default:
+		err = json.Unmarshal(data, &limits)
+	}
+	if err != nil {
+		return limits, fmt.Errorf("failed to parse rate limits %s: %w", path, err)
+	}
+	if err := limits.validate(); err != nil {
+		return limits, fmt.Errorf("invalid rate limits %s: %w", path, err)
+	}
+	return limits, nil
+}
+
+// validate checks every configured limit and kind
+func (l RateLimits) validate() error {
+	policies := map[string]RatePolicy{"default": l.Default}
+	for kind, policy := range l.Kinds {
+		if _, err := models.ParseKind(string(kind)); err != nil || kind == "" {
+			return fmt.Errorf("%w: %q", models.ErrInvalidKind, kind)
+		}
+		policies[string(kind)] = policy
+	}
+	for name, policy := range policies {
+		for scope, limit := range map[string]*ratelimit.Limit{
+			"sender": policy.Sender, "recipient": policy.Recipient, "global": policy.Global,
+		} {
+			if limit == nil {
+				continue
+			}
+			if err := limit.Validate(); err != nil {
+				return fmt.Errorf("%s %s: %w", name, scope, err)
+			}
+		}
+	}
+	return nil
+}
+
+// RateLimiter applies the rate limits to sends, with buckets kept by a limiter backend
+type RateLimiter struct {
+	limiter ratelimit.Limiter
+	limits  RateLimits
+}
+
+// NewRateLimiter applies limits with the buckets of limiter
+func NewRateLimiter(limiter ratelimit.Limiter, limits RateLimits) *RateLimiter {
+	return &RateLimiter{limiter: limiter, limits: limits}
+}
+
+// Scopes of the rate limit buckets
+const (
+	scopeSender    = "sender"
+	scopeRecipient = "recipient"
+	scopeGlobal    = "global"
+)
+
+// check takes a token from the sender, recipient and global buckets of the request kind
+// Returns zero when the send is allowed, otherwise how long until it would be
+// A nil rate limiter allows everything
+func (r *RateLimiter) check(req SendRequest) (time.Duration, error) {
+	return r.allow(req, scopeSender, scopeRecipient, scopeGlobal)
+}
+
+// checkSender takes a token from the sender bucket of the request kind only
+// Used by broadcasts, whose recipients are not chosen one by one
+func (r *RateLimiter) checkSender(req SendRequest) (time.Duration, error) {
+	return r.allow(req, scopeSender)
+}
+
+// allow takes a token from the buckets of the given scopes for the request kind
+func (r *RateLimiter) allow(req SendRequest, scopes ...string) (time.Duration, error) {
+	if r == nil {
+		return 0, nil
+	}
+	kind, err := models.ParseKind(req.Kind)
+	if err != nil {
+		// Rejected later with the other validation errors
+		return 0, nil
+	}
+
+	policy, hasKind := r.limits.Kinds[kind]
+	var requests []ratelimit.Request
+	add := func(scope string, kindLimit, defaultLimit *ratelimit.Limit, id string) {
+		limit, bucketKind := kindLimit, string(kind)
+		if limit == nil || !hasKind {
+			limit, bucketKind = defaultLimit, "*"
+		}
+		if limit != nil {
+			requests = append(requests, ratelimit.Request{
+				Key:   scope + ":" + bucketKind + ":" + id,
+				Limit: *limit,
+			})
+		}
+	}
+	for _, scope := range scopes {
+		switch scope {
+		case scopeSender:
+			add(scope, policy.Sender, r.limits.Default.Sender, strconv.Itoa(req.FromID))
+		case scopeRecipient:
+			add(scope, policy.Recipient, r.limits.Default.Recipient, strconv.Itoa(req.ToID))
+		case scopeGlobal:
+			add(scope, policy.Global, r.limits.Default.Global, "all")
+		}
+	}
+	if len(requests) == 0 {
+		return 0, nil
+	}
+	return r.limiter.Allow(requests...)
+}
+
+// allowSend checks the rate limits of a send and replies 429 Too Many Requests,
+// with a Retry-After header, when they are exceeded
+// Returns whether the send may proceed
+func allowSend(ctx *gin.Context, limiter *RateLimiter, req SendRequest) bool {
+	return respondLimited(ctx, limitWait(limiter.check, req))
+}
+
+// allowMulticast checks the rate limits of every recipient of a transactional send
+// and replies 429 Too Many Requests when one of them is exceeded. The transaction
+// reaches every recipient or none, so the recipients checked before the one over
+// its limit keep the tokens they spent
+// Returns whether the send may proceed
+func allowMulticast(ctx *gin.Context, limiter *RateLimiter, req MulticastRequest) bool {
+	seen := make(map[int]bool, len(req.ToIDs))
+	for _, toID := range req.ToIDs {
+		// Duplicate recipients are sent a single message
+		if seen[toID] {
+			continue
+		}
+		seen[toID] = true
+		wait := limitWait(limiter.check, SendRequest{FromID: req.FromID, ToID: toID, Kind: req.Kind})
+		if wait > 0 {
+			return respondLimited(ctx, wait)
+		}
+	}
+	return true
+}
+
+// allowBroadcast checks the sender rate limit of a broadcast and replies
+// 429 Too Many Requests when it is exceeded
+// Returns whether the broadcast may start
+func allowBroadcast(ctx *gin.Context, limiter *RateLimiter, req BroadcastRequest) bool {
+	return respondLimited(ctx, limitWait(limiter.checkSender, SendRequest{FromID: req.FromID, Kind: req.Kind}))
+}
+
+// limitWait runs a rate limit check and returns how long the send must wait
+// A failing limiter backend lets the send through rather than blocking every user
+func limitWait(check func(req SendRequest) (time.Duration, error), req SendRequest) time.Duration {
+	wait, err := check(req)
+	if err != nil {
+		logger.Error("Failed to check rate limits, allowing send", "error", err)
+		return 0
+	}
+	if wait > 0 {
+		logger.Warn("Rate limit exceeded", "fromID", req.FromID, "toID", req.ToID, "wait", wait)
+	}
+	return wait
+}
+
+// retryAfterSeconds rounds a wait up to the whole seconds of a Retry-After header
+func retryAfterSeconds(wait time.Duration) int {
+	return int(math.Ceil(wait.Seconds()))
+}
+
+// respondLimited replies 429 Too Many Requests with a Retry-After header when wait is positive
+// Returns whether the request may proceed
+func respondLimited(ctx *gin.Context, wait time.Duration) bool {
+	if wait == 0 {
+		return true
+	}
+	retryAfter := retryAfterSeconds(wait)
+	ctx.Header("Retry-After", strconv.Itoa(retryAfter))
+	ctx.JSON(http.StatusTooManyRequests, gin.H{
+		"message":    "rate limit exceeded",
+		"retryAfter": retryAfter,
+	})
+	return false
+}
+
+// limitBatch checks the rate limits of every valid item of a batch, in order
+// Returns the results of the items over their limits by index, the others may be sent
+func limitBatch(limiter *RateLimiter, reqs []SendRequest) map[int]BatchResult {
+	limited := make(map[int]BatchResult)
+	for i, req := range reqs {
+		// Invalid items are rejected by the send without spending tokens
+		if validateSendRequest(req) != nil {
+			continue
+		}
+		if wait := limitWait(limiter.check, req); wait > 0 {
+			limited[i] = BatchResult{
+				Index:      i,
+				Status:     BatchStatusRateLimited,
+				Error:      "rate limit exceeded",
+				RetryAfter: retryAfterSeconds(wait),
+			}
+		}
+	}
+	return limited
+}
+
+// sendLimitedBatch sends the items of a batch that are within their rate limits with send
+// Returns one result per item, in the same order, and the longest wait of the limited ones
+func sendLimitedBatch(limiter *RateLimiter, reqs []SendRequest,
+	send func(reqs []SendRequest) []BatchResult) ([]BatchResult, time.Duration) {
+	limited := limitBatch(limiter, reqs)
+	results := make([]BatchResult, len(reqs))
+	allowed := make([]SendRequest, 0, len(reqs)-len(limited))
+	indexes := make([]int, 0, len(reqs)-len(limited))
+	var wait time.Duration
+	for i, req := range reqs {
+		if result, ok := limited[i]; ok {
+			results[i] = result
+			wait = max(wait, time.Duration(result.RetryAfter)*time.Second)
+			continue
+		}
+		allowed = append(allowed, req)
+		indexes = append(indexes, i)
+	}
+	if len(allowed) > 0 {
+		for j, result := range send(allowed) {
+			result.Index = indexes[j]
+			results[indexes[j]] = result
+		}
+	}
+	return results, wait
+}
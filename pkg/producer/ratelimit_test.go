@@ -0,0 +1,98 @@
+package producer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"kafka-notify/pkg/ratelimit"
+
+	"github.com/IBM/sarama/mocks"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newSenderLimiter returns a rate limiter allowing burst sends per sender, barely refilled
+func newSenderLimiter(burst int) *RateLimiter {
+	return NewRateLimiter(ratelimit.NewMemoryLimiter(), RateLimits{
+		Default: RatePolicy{Sender: &ratelimit.Limit{Rate: 0.01, Burst: burst}},
+	})
+}
+
+// postJSON serves a JSON POST with handler
+func postJSON(handler gin.HandlerFunc, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.POST("/", handler)
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestBatchSendIsRateLimitedPerItem(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+	users := newTestDirectory()
+	handler := sendBatchHandler(func(reqs []SendRequest) []BatchResult {
+		return sendKafkaProducerBatch(producer, users, reqs)
+	}, newSenderLimiter(2))
+	batch := `{"notifications": [
+		{"fromID": 1, "toID": 2, "message": "a"},
+		{"fromID": 1, "toID": 3, "message": "b"},
+		{"fromID": 1, "toID": 3, "message": "c"}]}`
+
+	w := postJSON(handler, batch)
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	var response struct {
+		Sent    int           `json:"sent"`
+		Results []BatchResult `json:"results"`
+	}
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, 2, response.Sent)
+	require.Len(t, response.Results, 3)
+	assert.Equal(t, BatchStatusSent, response.Results[0].Status)
+	assert.Equal(t, BatchStatusSent, response.Results[1].Status)
+	assert.Equal(t, BatchResult{Index: 2, Status: BatchStatusRateLimited, Error: "rate limit exceeded",
+		RetryAfter: response.Results[2].RetryAfter}, response.Results[2])
+	assert.Positive(t, response.Results[2].RetryAfter)
+
+	// Every item over its limit rejects the whole batch
+	w = postJSON(handler, batch)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	require.NoError(t, producer.Close())
+}
+
+func TestTransactionalSendIsRateLimitedPerRecipient(t *testing.T) {
+	producer := newTxnProducer(t)
+	handler := sendTransactionalHandler(NewTransactionalSender(producer), newTestDirectory(), newSenderLimiter(1))
+
+	w := postJSON(handler, `{"fromID": 1, "toIDs": [2, 3], "message": "hello"}`)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	require.NoError(t, producer.Close())
+	assert.Zero(t, producer.began, "no transaction is started over the limit")
+}
+
+func TestBroadcastIsRateLimitedPerSender(t *testing.T) {
+	producer := mocks.NewSyncProducer(t, nil)
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+	jobs := NewJobTracker()
+	handler := broadcastHandler(context.Background(), producer, newTestDirectory(), jobs, newSenderLimiter(1))
+	broadcast := `{"fromID": 1, "all": true, "message": "hello"}`
+
+	assert.Equal(t, http.StatusAccepted, postJSON(handler, broadcast).Code)
+	w := postJSON(handler, broadcast)
+	assert.Equal(t, http.StatusTooManyRequests, w.Code)
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	jobs.Wait()
+	require.NoError(t, producer.Close())
+}
@@ -0,0 +1,170 @@
+package producer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+// MaxBatchSize is the largest number of notifications accepted by a batch send
+const MaxBatchSize = 500
+
+// Batch item statuses
+const (
+	BatchStatusSent        = "sent"
+	BatchStatusAccepted    = "accepted" // Written to the outbox, published by the relay
+	BatchStatusFailed      = "failed"
+	BatchStatusInvalid     = "invalid"
+	BatchStatusRateLimited = "rate_limited"
+)
+
+// SendRequest is a single notification to send
+// It is accepted as form fields (metadata as metadata[key]=value) or as a JSON body
+type SendRequest struct {
+	FromID         int               `form:"fromID" json:"fromID" binding:"required"`
+	ToID           int               `form:"toID" json:"toID" binding:"required"`
+	Message        string            `form:"message" json:"message" binding:"required,max=4096"`
+	Kind           string            `form:"kind" json:"kind"`
+	IdempotencyKey string            `form:"idempotencyKey" json:"idempotencyKey" binding:"max=256"`
+	Metadata       map[string]string `form:"-" json:"metadata"`
+	// DeliverAt delays the notification until the given time (RFC 3339)
+	DeliverAt *time.Time `form:"deliver_at" json:"deliver_at" time_format:"2006-01-02T15:04:05Z07:00"`
+	// CorrelationID comes from the X-Correlation-ID or X-Request-ID header of the HTTP request
+	CorrelationID string `form:"-" json:"-"`
+}
+
+// CreateUserRequest is the JSON body of a user creation, the ID is assigned when omitted
+type CreateUserRequest struct {
+	ID   int    `json:"id" binding:"min=0"`
+	Name string `json:"name" binding:"required,max=64"` // max is directory.MaxNameLength
+}
+
+// UpdateUserRequest is the JSON body of a user update, omitted fields are left unchanged
+type UpdateUserRequest struct {
+	Name        *string `json:"name" binding:"omitempty,max=64"`
+	Deactivated *bool   `json:"deactivated"`
+}
+
+// BatchRequest is the JSON body of a batch send
+// Items are validated one by one so a bad item does not reject the whole batch
+type BatchRequest struct {
+	Notifications []SendRequest `json:"notifications" binding:"required,min=1,max=500"` // max is MaxBatchSize
+}
+
+// BatchResult reports the outcome of one notification of a batch
+// Partition and offset are only set when the notification was sent
+type BatchResult struct {
+	Index     int               `json:"index"`
+	Status    string            `json:"status"`
+	ID        string            `json:"id,omitempty"`
+	Partition *int32            `json:"partition,omitempty"`
+	Offset    *int64            `json:"offset,omitempty"`
+	Error     string            `json:"error,omitempty"`
+	Errors    map[string]string `json:"errors,omitempty"`
+	// RetryAfter is the number of seconds to wait before retrying a rate-limited notification
+	RetryAfter int `json:"retryAfter,omitempty"`
+}
+
+func init() {
+	// Report validation errors with the JSON field names clients send
+	if engine, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		engine.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			return name
+		})
+	}
+}
+
+// bindSendRequest reads a send request from a JSON body or from form fields,
+// depending on the request content type
+func bindSendRequest(ctx *gin.Context) (SendRequest, error) {
+	var req SendRequest
+	if err := ctx.ShouldBind(&req); err != nil {
+		return req, err
+	}
+	if ctx.ContentType() != binding.MIMEJSON {
+		// Form metadata is sent as metadata[key]=value fields
+		if metadata := ctx.PostFormMap("metadata"); len(metadata) > 0 {
+			req.Metadata = metadata
+		}
+	}
+	req.CorrelationID = correlationID(ctx)
+	return req, nil
+}
+
+// validateSendRequest validates a request decoded outside of gin's binding, like batch items
+func validateSendRequest(req SendRequest) error {
+	return binding.Validator.ValidateStruct(req)
+}
+
+// numericFormFields are the form fields parsed as numbers
+var numericFormFields = []string{"fromID", "toID"}
+
+// fieldErrors turns a binding error into a map of field name to error message
+// ctx is only needed for form requests and may be nil otherwise
+// Returns nil when the error is not about specific fields
+func fieldErrors(ctx *gin.Context, err error) map[string]string {
+	var validationErrors validator.ValidationErrors
+	if errors.As(err, &validationErrors) {
+		fields := make(map[string]string, len(validationErrors))
+		for _, fieldErr := range validationErrors {
+			fields[fieldErr.Field()] = validationMessage(fieldErr)
+		}
+		return fields
+	}
+
+	// JSON body with a value of the wrong type, e.g. "fromID": "one"
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		return map[string]string{typeErr.Field: fmt.Sprintf("must be a %s", typeErr.Type)}
+	}
+
+	// Form field that is not a number, e.g. fromID=one
+	var numErr *strconv.NumError
+	if ctx != nil && errors.As(err, &numErr) {
+		for _, field := range numericFormFields {
+			if ctx.PostForm(field) == numErr.Num {
+				return map[string]string{field: fmt.Sprintf("invalid number %q", numErr.Num)}
+			}
+		}
+	}
+	return nil
+}
+
+// validationMessage describes why a field failed validation
+func validationMessage(fieldErr validator.FieldError) string {
+	switch fieldErr.Tag() {
+	case "required":
+		return "is required"
+	case "max":
+		return fmt.Sprintf("must be at most %s long", fieldErr.Param())
+	case "min":
+		if fieldErr.Kind() == reflect.Slice {
+			return fmt.Sprintf("must have at least %s items", fieldErr.Param())
+		}
+		return fmt.Sprintf("must be at least %s", fieldErr.Param())
+	default:
+		return fmt.Sprintf("failed %s validation", fieldErr.Tag())
+	}
+}
+
+// respondBindError replies 400 Bad Request with per-field errors when available
+func respondBindError(ctx *gin.Context, err error) {
+	if fields := fieldErrors(ctx, err); fields != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid request", "errors": fields})
+		return
+	}
+	ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+}
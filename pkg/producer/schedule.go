@@ -0,0 +1,180 @@
+package producer
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"kafka-notify/pkg/directory"
+	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/scheduler"
+
+	"github.com/alejoacosta74/go-logger"
+	"github.com/gin-gonic/gin"
+)
+
+// MaxScheduleAhead is how far in the future a notification can be scheduled
+const MaxScheduleAhead = 365 * 24 * time.Hour
+
+// ErrInvalidDeliverAt is returned when a delivery time is too far in the future
+var ErrInvalidDeliverAt = errors.New("deliver_at must be within a year")
+
+// RescheduleRequest is the JSON body of a reschedule
+type RescheduleRequest struct {
+	DeliverAt time.Time `json:"deliver_at" binding:"required"`
+}
+
+// isDelayed reports whether the request asks for a delivery in the future
+// A delivery time in the past is sent right away
+func isDelayed(req SendRequest) bool {
+	return req.DeliverAt != nil && req.DeliverAt.After(time.Now())
+}
+
+// validateDeliverAt checks that a delivery time is not too far in the future
+func validateDeliverAt(deliverAt time.Time) error {
+	if deliverAt.After(time.Now().Add(MaxScheduleAhead)) {
+		return ErrInvalidDeliverAt
+	}
+	return nil
+}
+
+// scheduleNotification validates the request now and stores the notification until it is due
+func scheduleNotification(sched *scheduler.Scheduler, users directory.UserDirectory,
+	req SendRequest) (scheduler.Scheduled, error) {
+	if err := validateDeliverAt(*req.DeliverAt); err != nil {
+		return scheduler.Scheduled{}, err
+	}
+	notification, err := buildNotification(users, req)
+	if err != nil {
+		return scheduler.Scheduled{}, err
+	}
+	return sched.Schedule(notification, *req.DeliverAt)
+}
+
+// respondScheduled schedules a delayed send and responds 202 Accepted with its delivery time
+func respondScheduled(ctx *gin.Context, sched *scheduler.Scheduler,
+	users directory.UserDirectory, req SendRequest) {
+	scheduled, err := scheduleNotification(sched, users, req)
+	if errors.Is(err, ErrInvalidDeliverAt) {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request",
+			"errors":  gin.H{"deliver_at": err.Error()},
+		})
+		return
+	}
+	if err != nil {
+		respondSendError(ctx, err)
+		return
+	}
+	ctx.Header("Location", "/scheduled/"+scheduled.ID)
+	ctx.JSON(http.StatusAccepted, gin.H{
+		"message":   "Notification scheduled",
+		"id":        scheduled.ID,
+		"deliverAt": scheduled.DeliverAt,
+	})
+}
+
+// newSchedulerPublisher returns the function the scheduler hands due notifications to
+// Users deactivated since the notification was scheduled are skipped
+func newSchedulerPublisher(users directory.UserDirectory,
+	deliver func(notification models.Notification) error) scheduler.PublishFunc {
+	return func(notification models.Notification) error {
+		for _, id := range []int{notification.From.ID, notification.To.ID} {
+			_, err := findActiveUser(id, users)
+			if errors.Is(err, ErrUserDeactivated) || errors.Is(err, ErrUserNotFoundInProducer) {
+				logger.Warn("Dropping scheduled notification", "id", notification.ID, "error", err)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+		// The notification is created when it is delivered, not when it was scheduled
+		notification.CreatedAt = time.Now().UTC()
+		return deliver(notification)
+	}
+}
+
+// listScheduledHandler creates a Gin HTTP handler listing the scheduled notifications,
+// earliest delivery first
+func listScheduledHandler(sched *scheduler.Scheduler) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		limit := 100
+		if value := ctx.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid limit"})
+				return
+			}
+			limit = parsed
+		}
+		list, err := sched.List(limit)
+		if err != nil {
+			logger.Error("Failed to list scheduled notifications", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		if list == nil {
+			list = []scheduler.Scheduled{}
+		}
+		ctx.JSON(http.StatusOK, gin.H{"scheduled": list})
+	}
+}
+
+// getScheduledHandler creates a Gin HTTP handler returning a scheduled notification
+func getScheduledHandler(sched *scheduler.Scheduler) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		scheduled, err := sched.Get(ctx.Param("id"))
+		if err != nil {
+			respondScheduleError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, scheduled)
+	}
+}
+
+// cancelScheduledHandler creates a Gin HTTP handler cancelling a scheduled notification
+func cancelScheduledHandler(sched *scheduler.Scheduler) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if err := sched.Cancel(ctx.Param("id")); err != nil {
+			respondScheduleError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"message": "Scheduled notification cancelled"})
+	}
+}
+
+// rescheduleHandler creates a Gin HTTP handler moving a scheduled notification to a new time
+func rescheduleHandler(sched *scheduler.Scheduler) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req RescheduleRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			respondBindError(ctx, err)
+			return
+		}
+		if err := validateDeliverAt(req.DeliverAt); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid request",
+				"errors":  gin.H{"deliver_at": err.Error()},
+			})
+			return
+		}
+		scheduled, err := sched.Reschedule(ctx.Param("id"), req.DeliverAt)
+		if err != nil {
+			respondScheduleError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusOK, scheduled)
+	}
+}
+
+// respondScheduleError maps scheduler errors to HTTP statuses
+func respondScheduleError(ctx *gin.Context, err error) {
+	if errors.Is(err, scheduler.ErrNotScheduled) {
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+		return
+	}
+	logger.Error("Scheduler error", "error", err)
+	ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+}
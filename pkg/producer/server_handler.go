@@ -1,12 +1,15 @@
 package producer
 
 import (
+	"context"
 	"errors"
-	"fmt"
 	"net/http"
 	"strconv"
 
+	"kafka-notify/pkg/directory"
 	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/outbox"
+	"kafka-notify/pkg/scheduler"
 
 	"github.com/IBM/sarama"
 	"github.com/alejoacosta74/go-logger"
@@ -14,43 +17,34 @@ import (
 )
 
 // sendMessageHandler creates a Gin HTTP handler for sending messages between users
-// It takes a Kafka producer and a list of users as parameters
-func sendMessageHandler(producer sarama.SyncProducer,
-	users []models.User) gin.HandlerFunc {
+// It takes a Kafka producer, the user directory, the scheduler and the rate limiter as parameters
+// The notification is read from form fields or from a JSON body
+func sendMessageHandler(producer sarama.SyncProducer, users directory.UserDirectory,
+	sched *scheduler.Scheduler, limiter *RateLimiter) gin.HandlerFunc {
 	// Return a closure that handles the actual HTTP request
 	return func(ctx *gin.Context) {
-		// Extract and parse the sender's ID from the form data
-		fromID, err := getIDFromRequest("fromID", ctx)
+		// Extract and validate the notification from the request
+		req, err := bindSendRequest(ctx)
 		if err != nil {
-			logger.Error("Failed to get sender ID from request", "error", err)
-			// Return 400 Bad Request if sender ID is invalid
-			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			logger.Error("Invalid send request", "error", err)
+			// Return 400 Bad Request with the fields that failed validation
+			respondBindError(ctx, err)
 			return
 		}
-
-		// Extract and parse the recipient's ID from the form data
-		toID, err := getIDFromRequest("toID", ctx)
-		if err != nil {
-			logger.Error("Failed to get recipient ID from request", "error", err)
-			// Return 400 Bad Request if recipient ID is invalid
-			ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+		// Return 429 Too Many Requests when the sender, recipient or global rate is exceeded
+		if !allowSend(ctx, limiter, req) {
 			return
 		}
-
-		// Attempt to send the message to Kafka
-		err = sendKafkaProducerMessage(producer, users, ctx, fromID, toID)
-		if errors.Is(err, ErrUserNotFoundInProducer) {
-			// Return 404 Not Found if either user doesn't exist
-			logger.Error("User not found", "error", err)
-			ctx.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		// Hold notifications with a future deliver_at until they are due
+		if isDelayed(req) {
+			respondScheduled(ctx, sched, users, req)
 			return
 		}
+
+		// Attempt to send the message to Kafka
+		notification, err := sendKafkaProducerMessage(producer, users, req)
 		if err != nil {
-			// Return 500 Internal Server Error for any other errors
-			logger.Error("Failed to send message to Kafka", "error", err)
-			ctx.JSON(http.StatusInternalServerError, gin.H{
-				"message": err.Error(),
-			})
+			respondSendError(ctx, err)
 			return
 		}
 
@@ -58,21 +52,402 @@ func sendMessageHandler(producer sarama.SyncProducer,
 		logger.Info("Notification sent successfully!")
 		ctx.JSON(http.StatusOK, gin.H{
 			"message": "Notification sent successfully!",
+			"id":      notification.ID,
+		})
+	}
+}
+
+// sendAsyncHandler creates a Gin HTTP handler queueing notifications on the async producer
+// Responds 202 Accepted as soon as the notification is queued, the delivery is
+// then followed with the status endpoint
+func sendAsyncHandler(producer sarama.AsyncProducer, users directory.UserDirectory,
+	deliveries *DeliveryTracker, sched *scheduler.Scheduler, limiter *RateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req, err := bindSendRequest(ctx)
+		if err != nil {
+			logger.Error("Invalid send request", "error", err)
+			respondBindError(ctx, err)
+			return
+		}
+		if !allowSend(ctx, limiter, req) {
+			return
+		}
+		if isDelayed(req) {
+			respondScheduled(ctx, sched, users, req)
+			return
+		}
+
+		notification, err := sendKafkaProducerMessageAsync(producer, users, deliveries, req)
+		if err != nil {
+			respondSendError(ctx, err)
+			return
+		}
+
+		statusURL := "/send/" + notification.ID + "/status"
+		ctx.Header("Location", statusURL)
+		ctx.JSON(http.StatusAccepted, gin.H{
+			"message": "Notification accepted",
+			"id":      notification.ID,
+			"status":  statusURL,
+		})
+	}
+}
+
+// sendOutboxHandler creates a Gin HTTP handler writing notifications to the local outbox
+// Responds 202 Accepted once the notification is durably stored, it is published
+// to Kafka by the relay, retrying while the broker is unavailable
+func sendOutboxHandler(box *outbox.Outbox, users directory.UserDirectory,
+	sched *scheduler.Scheduler, limiter *RateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		req, err := bindSendRequest(ctx)
+		if err != nil {
+			logger.Error("Invalid send request", "error", err)
+			respondBindError(ctx, err)
+			return
+		}
+		if !allowSend(ctx, limiter, req) {
+			return
+		}
+		if isDelayed(req) {
+			respondScheduled(ctx, sched, users, req)
+			return
+		}
+
+		notification, err := enqueueNotification(box, users, req)
+		if err != nil {
+			respondSendError(ctx, err)
+			return
+		}
+		ctx.JSON(http.StatusAccepted, gin.H{
+			"message": "Notification accepted",
+			"id":      notification.ID,
+		})
+	}
+}
+
+// outboxHandler creates a Gin HTTP handler reporting the outbox depth, the relay
+// activity and the entries that failed to publish at least once
+func outboxHandler(box *outbox.Outbox, relay *outbox.Relay) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		limit := 100
+		if value := ctx.Query("limit"); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 1 {
+				ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid limit"})
+				return
+			}
+			limit = parsed
+		}
+		stuck, err := box.Stuck(limit)
+		if err != nil {
+			logger.Error("Failed to read outbox", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		if stuck == nil {
+			stuck = []outbox.Entry{}
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"stats": relay.Stats(),
+			"stuck": stuck,
+		})
+	}
+}
+
+// sendStatusHandler creates a Gin HTTP handler returning the delivery status of an async send
+func sendStatusHandler(deliveries *DeliveryTracker) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		delivery, err := deliveries.Get(ctx.Param("id"))
+		if errors.Is(err, ErrDeliveryNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, delivery)
+	}
+}
+
+// respondSendError maps the errors of a single send to HTTP statuses
+func respondSendError(ctx *gin.Context, err error) {
+	if errors.Is(err, models.ErrInvalidKind) {
+		// Return 400 Bad Request if the notification kind is not supported
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"message": "invalid request",
+			"errors":  gin.H{"kind": err.Error()},
+		})
+		return
+	}
+	if errors.Is(err, ErrUserNotFoundInProducer) {
+		// Return 404 Not Found if either user doesn't exist
+		logger.Error("User not found", "error", err)
+		ctx.JSON(http.StatusNotFound, gin.H{"message": "User not found"})
+		return
+	}
+	if errors.Is(err, ErrUserDeactivated) {
+		// Return 403 Forbidden if either user was deactivated
+		logger.Error("User deactivated", "error", err)
+		ctx.JSON(http.StatusForbidden, gin.H{"message": "User deactivated"})
+		return
+	}
+	// Return 500 Internal Server Error for any other errors
+	logger.Error("Failed to send message to Kafka", "error", err)
+	ctx.JSON(http.StatusInternalServerError, gin.H{
+		"message": err.Error(),
+	})
+}
+
+// sendBatchHandler creates a Gin HTTP handler publishing many notifications at once with send
+// Responds 200 OK when every notification was sent, 202 Accepted when every one was written
+// to the outbox, 207 Multi-Status otherwise, with the outcome of each notification in the
+// same order as the request
+// Every notification is rate limited on its own, 429 Too Many Requests means all were
+func sendBatchHandler(send func(reqs []SendRequest) []BatchResult, limiter *RateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req BatchRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			logger.Error("Invalid batch request", "error", err)
+			respondBindError(ctx, err)
+			return
+		}
+		for i := range req.Notifications {
+			req.Notifications[i].CorrelationID = correlationID(ctx)
+		}
+
+		results, wait := sendLimitedBatch(limiter, req.Notifications, send)
+
+		sent, accepted, limited := 0, 0, 0
+		for _, result := range results {
+			switch result.Status {
+			case BatchStatusSent:
+				sent++
+			case BatchStatusAccepted:
+				accepted++
+			case BatchStatusRateLimited:
+				limited++
+			}
+		}
+		status := http.StatusOK
+		switch {
+		case limited == len(results):
+			status = http.StatusTooManyRequests
+			ctx.Header("Retry-After", strconv.Itoa(retryAfterSeconds(wait)))
+		case sent+accepted < len(results):
+			status = http.StatusMultiStatus
+		case accepted > 0:
+			status = http.StatusAccepted
+		}
+		ctx.JSON(status, gin.H{
+			"sent":     sent,
+			"accepted": accepted,
+			"failed":   len(results) - sent - accepted,
+			"results":  results,
+		})
+	}
+}
+
+// sendTransactionalHandler creates a Gin HTTP handler sending one notification to several
+// users in a single Kafka transaction: every recipient gets it or none does
+// The send is rejected with 429 Too Many Requests when any recipient is over its rate limits
+func sendTransactionalHandler(transactions *TransactionalSender, users directory.UserDirectory,
+	limiter *RateLimiter) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req MulticastRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			logger.Error("Invalid transactional send request", "error", err)
+			respondBindError(ctx, err)
+			return
+		}
+		req.CorrelationID = correlationID(ctx)
+		if transactions != nil && !allowMulticast(ctx, limiter, req) {
+			return
+		}
+
+		notifications, err := transactions.Send(users, req)
+		if errors.Is(err, ErrTransactionsDisabled) {
+			ctx.JSON(http.StatusNotImplemented, gin.H{"message": err.Error()})
+			return
+		}
+		if err != nil {
+			respondSendError(ctx, err)
+			return
+		}
+
+		ids := make([]string, 0, len(notifications))
+		for _, notification := range notifications {
+			ids = append(ids, notification.ID)
+		}
+		ctx.JSON(http.StatusOK, gin.H{
+			"message": "Notifications committed",
+			"ids":     ids,
 		})
 	}
 }
 
-// getIDFromRequest extracts and parses a user ID from the HTTP form data
-// It takes the form field name and the Gin context as parameters
-func getIDFromRequest(formValue string, ctx *gin.Context) (int, error) {
-	// Extract the string value from the form and convert it to an integer
-	id, err := strconv.Atoi(ctx.PostForm(formValue))
+// broadcastHandler creates a Gin HTTP handler fanning a notification out to many recipients
+// The messages are published in the background, it responds 202 Accepted with the job to poll
+// Starting a broadcast spends a token of the sender rate limit
+func broadcastHandler(ctx context.Context, producer sarama.SyncProducer,
+	users directory.UserDirectory, jobs *JobTracker, limiter *RateLimiter) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var req BroadcastRequest
+		if err := c.ShouldBindJSON(&req); err != nil {
+			logger.Error("Invalid broadcast request", "error", err)
+			respondBindError(c, err)
+			return
+		}
+		req.CorrelationID = correlationID(c)
+		if !allowBroadcast(c, limiter, req) {
+			return
+		}
+
+		job, err := startBroadcast(ctx, producer, users, jobs, req)
+		switch {
+		case errors.Is(err, models.ErrInvalidKind):
+			c.JSON(http.StatusBadRequest, gin.H{
+				"message": "invalid request",
+				"errors":  gin.H{"kind": err.Error()},
+			})
+			return
+		case errors.Is(err, ErrInvalidTarget), errors.Is(err, ErrNoRecipients):
+			c.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+			return
+		case errors.Is(err, directory.ErrGroupNotFound), errors.Is(err, ErrUserNotFoundInProducer):
+			c.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		case errors.Is(err, ErrUserDeactivated):
+			c.JSON(http.StatusForbidden, gin.H{"message": err.Error()})
+			return
+		case err != nil:
+			logger.Error("Failed to start broadcast", "error", err)
+			c.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+
+		c.Header("Location", "/broadcast/"+job.ID)
+		c.JSON(http.StatusAccepted, job)
+	}
+}
+
+// broadcastStatusHandler creates a Gin HTTP handler returning the progress of a broadcast job
+func broadcastStatusHandler(jobs *JobTracker) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		job, err := jobs.Get(ctx.Param("jobID"))
+		if errors.Is(err, ErrJobNotFound) {
+			ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, job)
+	}
+}
+
+// listUsersHandler creates a Gin HTTP handler returning every user of the directory,
+// including the deactivated ones
+func listUsersHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		list, err := users.List()
+		if err != nil {
+			logger.Error("Failed to list users", "error", err)
+			ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
+			return
+		}
+		ctx.JSON(http.StatusOK, gin.H{"users": list})
+	}
+}
+
+// createUserHandler creates a Gin HTTP handler adding a user to the directory
+// Responds 201 Created with the user, including its assigned ID
+func createUserHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		editor, ok := users.(directory.Editor)
+		if !ok {
+			respondUserError(ctx, directory.ErrReadOnly)
+			return
+		}
+		var req CreateUserRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			respondBindError(ctx, err)
+			return
+		}
+
+		user, err := editor.Create(models.User{ID: req.ID, Name: req.Name})
+		if err != nil {
+			respondUserError(ctx, err)
+			return
+		}
+		logger.Info("User created", "id", user.ID, "name", user.Name)
+		ctx.JSON(http.StatusCreated, user)
+	}
+}
+
+// updateUserHandler creates a Gin HTTP handler renaming, deactivating or reactivating a user
+func updateUserHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		var req UpdateUserRequest
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			respondBindError(ctx, err)
+			return
+		}
+		changeUser(ctx, users, func(user *models.User) {
+			if req.Name != nil {
+				user.Name = *req.Name
+			}
+			if req.Deactivated != nil {
+				user.Deactivated = *req.Deactivated
+			}
+		})
+	}
+}
+
+// deactivateUserHandler creates a Gin HTTP handler deactivating a user
+// Deactivated users stay in the directory but cannot send or receive notifications
+func deactivateUserHandler(users directory.UserDirectory) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		changeUser(ctx, users, func(user *models.User) {
+			user.Deactivated = true
+		})
+	}
+}
+
+// changeUser applies a change to the user named by the userID path parameter
+// and responds with the updated user
+func changeUser(ctx *gin.Context, users directory.UserDirectory, change func(user *models.User)) {
+	editor, ok := users.(directory.Editor)
+	if !ok {
+		respondUserError(ctx, directory.ErrReadOnly)
+		return
+	}
+	id, err := strconv.Atoi(ctx.Param("userID"))
+	if err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": "invalid user ID"})
+		return
+	}
+
+	user, err := users.Lookup(id)
 	if err != nil {
-		// If conversion fails, return an error with details about which field failed
-		logger.Error("Failed to parse ID from form value", "error", err)
-		return 0, fmt.Errorf(
-			"failed to parse ID from form value %s: %w", formValue, err)
+		respondUserError(ctx, err)
+		return
+	}
+	change(&user)
+	if user, err = editor.Update(user); err != nil {
+		respondUserError(ctx, err)
+		return
+	}
+	logger.Info("User updated", "id", user.ID, "name", user.Name, "deactivated", user.Deactivated)
+	ctx.JSON(http.StatusOK, user)
+}
+
+// respondUserError maps user directory errors to HTTP statuses
+func respondUserError(ctx *gin.Context, err error) {
+	switch {
+	case errors.Is(err, directory.ErrUserNotFound):
+		ctx.JSON(http.StatusNotFound, gin.H{"message": err.Error()})
+	case errors.Is(err, directory.ErrUserExists):
+		ctx.JSON(http.StatusConflict, gin.H{"message": err.Error()})
+	case errors.Is(err, directory.ErrInvalidUser):
+		ctx.JSON(http.StatusBadRequest, gin.H{"message": err.Error()})
+	case errors.Is(err, directory.ErrReadOnly):
+		ctx.JSON(http.StatusNotImplemented, gin.H{"message": err.Error()})
+	default:
+		logger.Error("User directory error", "error", err)
+		ctx.JSON(http.StatusInternalServerError, gin.H{"message": err.Error()})
 	}
-	// Return the successfully parsed integer ID
-	return id, nil
 }
@@ -0,0 +1,110 @@
+package producer
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"kafka-notify/pkg/directory"
+	"kafka-notify/pkg/models"
+
+	"github.com/IBM/sarama"
+	"github.com/alejoacosta74/go-logger"
+)
+
+var (
+	// ErrTransactionsDisabled is returned when no transactional ID is configured
+	ErrTransactionsDisabled = errors.New("transactional producer is not configured")
+	// ErrTransactionAborted is returned when a transaction was rolled back, no recipient sees the notification
+	ErrTransactionAborted = errors.New("transaction aborted")
+)
+
+// MulticastRequest is the JSON body of a transactional send of one notification to several users
+type MulticastRequest struct {
+	FromID         int               `json:"fromID" binding:"required"`
+	ToIDs          []int             `json:"toIDs" binding:"required,min=1,max=500"` // max is MaxBatchSize
+	Message        string            `json:"message" binding:"required,max=4096"`
+	Kind           string            `json:"kind"`
+	IdempotencyKey string            `json:"idempotencyKey" binding:"max=256"`
+	Metadata       map[string]string `json:"metadata"`
+	// CorrelationID comes from the X-Correlation-ID or X-Request-ID header of the HTTP request
+	CorrelationID string `json:"-"`
+}
+
+// TransactionalSender publishes the messages of a multicast in a single Kafka transaction
+// so consumers reading committed messages see them for every recipient or for none
+// A producer runs one transaction at a time, sends are serialized
+type TransactionalSender struct {
+	mu       sync.Mutex
+	producer sarama.SyncProducer
+}
+
+// NewTransactionalSender wraps a producer created with a transactional ID
+func NewTransactionalSender(producer sarama.SyncProducer) *TransactionalSender {
+	return &TransactionalSender{producer: producer}
+}
+
+// Send validates every recipient first, then publishes one message per recipient,
+// keyed by recipient ID, inside a transaction that is committed or aborted as a whole
+// Returns the notifications that were committed
+func (s *TransactionalSender) Send(users directory.UserDirectory, req MulticastRequest) ([]models.Notification, error) {
+	if s == nil {
+		return nil, ErrTransactionsDisabled
+	}
+
+	// Build every message up front so an unknown recipient rejects the whole request
+	seen := make(map[int]bool, len(req.ToIDs))
+	notifications := make([]models.Notification, 0, len(req.ToIDs))
+	messages := make([]*sarama.ProducerMessage, 0, len(req.ToIDs))
+	for _, toID := range req.ToIDs {
+		if seen[toID] {
+			continue
+		}
+		seen[toID] = true
+		notification, err := buildNotification(users, SendRequest{
+			FromID:         req.FromID,
+			ToID:           toID,
+			Message:        req.Message,
+			Kind:           req.Kind,
+			IdempotencyKey: req.IdempotencyKey,
+			Metadata:       req.Metadata,
+			CorrelationID:  req.CorrelationID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		msg, err := newProducerMessage(notification)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, notification)
+		messages = append(messages, msg)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.producer.BeginTxn(); err != nil {
+		logger.Error("Failed to begin transaction", "error", err)
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	if err := s.producer.SendMessages(messages); err != nil {
+		logger.Error("Failed to send transaction messages, aborting", "error", err)
+		return nil, s.abort(err)
+	}
+	if err := s.producer.CommitTxn(); err != nil {
+		logger.Error("Failed to commit transaction, aborting", "error", err)
+		return nil, s.abort(err)
+	}
+
+	logger.Info("Transaction committed", "recipients", len(notifications))
+	return notifications, nil
+}
+
+// abort rolls the current transaction back and reports why it failed
+func (s *TransactionalSender) abort(cause error) error {
+	if err := s.producer.AbortTxn(); err != nil {
+		logger.Error("Failed to abort transaction", "error", err)
+		return fmt.Errorf("%w: %w (abort failed: %v)", ErrTransactionAborted, cause, err)
+	}
+	return fmt.Errorf("%w: %w", ErrTransactionAborted, cause)
+}
@@ -0,0 +1,100 @@
+package producer
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/IBM/sarama/mocks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// txnProducer records how the transactions of a mock transactional producer ended
+type txnProducer struct {
+	*mocks.SyncProducer
+	t         *testing.T
+	began     int
+	committed int
+	aborted   int
+}
+
+// newTxnProducer returns a mock producer configured like setupTransactionalProducer
+func newTxnProducer(t *testing.T) *txnProducer {
+	config := newProducerConfig(DeliveryOptions{Idempotent: true})
+	config.Producer.Transaction.ID = "test"
+	config.Version = sarama.V2_5_0_0
+	return &txnProducer{SyncProducer: mocks.NewSyncProducer(t, config), t: t}
+}
+
+func (p *txnProducer) BeginTxn() error {
+	p.began++
+	return p.SyncProducer.BeginTxn()
+}
+
+func (p *txnProducer) SendMessages(msgs []*sarama.ProducerMessage) error {
+	assert.NotZero(p.t, p.TxnStatus()&sarama.ProducerTxnFlagInTransaction, "sent outside a transaction")
+	return p.SyncProducer.SendMessages(msgs)
+}
+
+func (p *txnProducer) CommitTxn() error {
+	p.committed++
+	return p.SyncProducer.CommitTxn()
+}
+
+func (p *txnProducer) AbortTxn() error {
+	p.aborted++
+	return p.SyncProducer.AbortTxn()
+}
+
+func TestTransactionalSendCommits(t *testing.T) {
+	producer := newTxnProducer(t)
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndSucceed()
+
+	notifications, err := NewTransactionalSender(producer).Send(newTestDirectory(),
+		MulticastRequest{FromID: 1, ToIDs: []int{2, 3, 2}, Message: "hello"})
+	require.NoError(t, err)
+	require.NoError(t, producer.Close())
+
+	require.Len(t, notifications, 2, "duplicate recipients are sent once")
+	assert.Equal(t, 2, notifications[0].To.ID)
+	assert.Equal(t, 3, notifications[1].To.ID)
+	assert.Equal(t, 1, producer.committed)
+	assert.Zero(t, producer.aborted)
+}
+
+func TestTransactionalSendAbortsWhenASendFails(t *testing.T) {
+	producer := newTxnProducer(t)
+	cause := errors.New("broker unavailable")
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndFail(cause)
+
+	notifications, err := NewTransactionalSender(producer).Send(newTestDirectory(),
+		MulticastRequest{FromID: 1, ToIDs: []int{2, 3}, Message: "hello"})
+	require.NoError(t, producer.Close())
+
+	assert.ErrorIs(t, err, ErrTransactionAborted)
+	assert.ErrorIs(t, err, cause)
+	assert.Nil(t, notifications)
+	assert.Equal(t, 1, producer.aborted)
+	assert.Zero(t, producer.committed)
+}
+
+func TestTransactionalSendRejectsUnknownRecipient(t *testing.T) {
+	// No send is expected: the whole request is rejected before the transaction begins
+	producer := newTxnProducer(t)
+
+	_, err := NewTransactionalSender(producer).Send(newTestDirectory(),
+		MulticastRequest{FromID: 1, ToIDs: []int{2, 99}, Message: "hello"})
+	require.NoError(t, producer.Close())
+
+	assert.ErrorIs(t, err, ErrUserNotFoundInProducer)
+	assert.Zero(t, producer.began)
+}
+
+func TestTransactionalSendDisabled(t *testing.T) {
+	var sender *TransactionalSender
+	_, err := sender.Send(newTestDirectory(), MulticastRequest{FromID: 1, ToIDs: []int{2}, Message: "hello"})
+	assert.ErrorIs(t, err, ErrTransactionsDisabled)
+}
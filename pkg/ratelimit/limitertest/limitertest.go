@@ -0,0 +1,133 @@
+// Package limitertest provides a conformance suite that every ratelimit.Limiter
+// implementation must pass. Backends call Run from their own tests:
+//
+//	func TestSQLiteLimiter(t *testing.T) {
+//		limitertest.Run(t, func(t *testing.T) ratelimit.Limiter {
+//			l, err := ratelimit.OpenSQLiteLimiter(filepath.Join(t.TempDir(), "limits.db"))
+//			require.NoError(t, err)
+//			return l
+//		})
+//	}
+package limitertest
+
+import (
+	"testing"
+	"time"
+
+	"kafka-notify/pkg/ratelimit"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory creates a new limiter with no bucket for a single test
+// The suite closes the limiter when the test ends
+type Factory func(t *testing.T) ratelimit.Limiter
+
+// Run executes the whole conformance suite against the limiters built by newLimiter
+func Run(t *testing.T, newLimiter Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, l ratelimit.Limiter)
+	}{
+		{"BucketsStartFull", testBucketsStartFull},
+		{"BucketsAreIndependent", testBucketsAreIndependent},
+		{"RefillOverTime", testRefillOverTime},
+		{"RefillCappedAtBurst", testRefillCappedAtBurst},
+		{"WaitUntilNextToken", testWaitUntilNextToken},
+		{"AllOrNone", testAllOrNone},
+		{"InvalidLimit", testInvalidLimit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newLimiter(t)
+			t.Cleanup(func() { assert.NoError(t, l.Close()) })
+			tt.fn(t, l)
+		})
+	}
+}
+
+// slow barely refills during a test
+var slow = ratelimit.Limit{Rate: 0.001, Burst: 1}
+
+// request asks for a token of key with limit
+func request(key string, limit ratelimit.Limit) ratelimit.Request {
+	return ratelimit.Request{Key: key, Limit: limit}
+}
+
+// allow takes a token and fails the test when the limiter errors
+func allow(t *testing.T, l ratelimit.Limiter, requests ...ratelimit.Request) time.Duration {
+	t.Helper()
+	wait, err := l.Allow(requests...)
+	require.NoError(t, err)
+	return wait
+}
+
+func testBucketsStartFull(t *testing.T, l ratelimit.Limiter) {
+	limit := ratelimit.Limit{Rate: 0.001, Burst: 3}
+	for i := 0; i < 3; i++ {
+		assert.Zero(t, allow(t, l, request("sender:1", limit)), "token %d", i)
+	}
+	assert.Positive(t, allow(t, l, request("sender:1", limit)))
+}
+
+func testBucketsAreIndependent(t *testing.T, l ratelimit.Limiter) {
+	assert.Zero(t, allow(t, l, request("sender:1", slow)))
+	assert.Positive(t, allow(t, l, request("sender:1", slow)))
+	assert.Zero(t, allow(t, l, request("sender:2", slow)))
+}
+
+func testRefillOverTime(t *testing.T, l ratelimit.Limiter) {
+	limit := ratelimit.Limit{Rate: 20, Burst: 1}
+	assert.Zero(t, allow(t, l, request("sender:1", limit)))
+	assert.Positive(t, allow(t, l, request("sender:1", limit)))
+
+	// One token every 50ms
+	time.Sleep(60 * time.Millisecond)
+	assert.Zero(t, allow(t, l, request("sender:1", limit)))
+}
+
+func testRefillCappedAtBurst(t *testing.T, l ratelimit.Limiter) {
+	limit := ratelimit.Limit{Rate: 100, Burst: 2}
+	assert.Zero(t, allow(t, l, request("sender:1", limit)))
+	// Long enough for many tokens, the bucket still holds only Burst
+	time.Sleep(50 * time.Millisecond)
+	assert.Zero(t, allow(t, l, request("sender:1", limit)))
+	assert.Zero(t, allow(t, l, request("sender:1", limit)))
+	assert.Positive(t, allow(t, l, request("sender:1", limit)))
+}
+
+func testWaitUntilNextToken(t *testing.T, l ratelimit.Limiter) {
+	limit := ratelimit.Limit{Rate: 0.5, Burst: 1}
+	assert.Zero(t, allow(t, l, request("sender:1", limit)))
+
+	// An empty bucket refilled at 0.5 tokens per second has a token in 2s
+	wait := allow(t, l, request("sender:1", limit))
+	assert.InDelta(t, 2*time.Second, wait, float64(100*time.Millisecond))
+
+	// The longest wait of the requested buckets is returned
+	assert.Zero(t, allow(t, l, request("recipient:2", slow)))
+	wait = allow(t, l, request("sender:1", limit), request("recipient:2", slow))
+	assert.InDelta(t, 1000*time.Second, wait, float64(time.Second))
+}
+
+func testAllOrNone(t *testing.T, l ratelimit.Limiter) {
+	sender, recipient, global := request("sender:1", slow), request("recipient:2", slow),
+		request("global:all", ratelimit.Limit{Rate: 0.001, Burst: 2})
+	// Empty the sender bucket only
+	assert.Zero(t, allow(t, l, sender))
+
+	assert.Positive(t, allow(t, l, sender, recipient, global))
+	// Neither the recipient nor the global bucket lost a token to the rejected send
+	assert.Zero(t, allow(t, l, recipient))
+	assert.Zero(t, allow(t, l, global))
+	assert.Zero(t, allow(t, l, global))
+	assert.Positive(t, allow(t, l, global))
+}
+
+func testInvalidLimit(t *testing.T, l ratelimit.Limiter) {
+	_, err := l.Allow(request("sender:1", ratelimit.Limit{Rate: 0, Burst: 1}))
+	assert.ErrorIs(t, err, ratelimit.ErrInvalidLimit)
+	_, err = l.Allow(request("sender:1", ratelimit.Limit{Rate: 1, Burst: 0}))
+	assert.ErrorIs(t, err, ratelimit.ErrInvalidLimit)
+}
@@ -0,0 +1,71 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// sweepInterval is how often buckets that refilled completely are forgotten
+const sweepInterval = time.Minute
+
+// memoryBucket is a bucket with the limit it was last used with
+type memoryBucket struct {
+	bucket
+	limit Limit
+}
+
+// MemoryLimiter keeps the buckets in memory, limits only apply to this producer
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]memoryBucket
+	lastSweep time.Time
+}
+
+// NewMemoryLimiter creates an in-memory limiter
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{buckets: make(map[string]memoryBucket), lastSweep: time.Now()}
+}
+
+// Allow takes one token from every requested bucket, or from none of them when one is empty
+func (l *MemoryLimiter) Allow(requests ...Request) (time.Duration, error) {
+	for _, request := range requests {
+		if err := request.Limit.Validate(); err != nil {
+			return 0, err
+		}
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	buckets := make([]bucket, len(requests))
+	for i, request := range requests {
+		buckets[i] = l.buckets[request.Key].bucket
+	}
+	buckets, wait := take(buckets, requests, now)
+	if wait > 0 {
+		return wait, nil
+	}
+	for i, request := range requests {
+		l.buckets[request.Key] = memoryBucket{bucket: buckets[i], limit: request.Limit}
+	}
+	return 0, nil
+}
+
+// sweep forgets the buckets that are full again, they start full when used next
+func (l *MemoryLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return
+	}
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if !now.Before(b.fullAt(b.limit)) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Close releases nothing, the buckets are garbage collected
+func (l *MemoryLimiter) Close() error {
+	return nil
+}
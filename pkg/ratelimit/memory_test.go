@@ -0,0 +1,14 @@
+package ratelimit_test
+
+import (
+	"testing"
+
+	"kafka-notify/pkg/ratelimit"
+	"kafka-notify/pkg/ratelimit/limitertest"
+)
+
+func TestMemoryLimiter(t *testing.T) {
+	limitertest.Run(t, func(t *testing.T) ratelimit.Limiter {
+		return ratelimit.NewMemoryLimiter()
+	})
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Limiter backends
+const (
+	BackendMemory = "memory"
+	BackendSQLite = "sqlite"
+)
+
+var (
+	// ErrUnknownBackend is returned when the configured limiter backend does not exist
+	ErrUnknownBackend = errors.New("unknown rate limiter backend")
+	// ErrInvalidLimit is returned when a limit has no rate or no burst
+	ErrInvalidLimit = errors.New("invalid rate limit")
+)
+
+// Limit is a token bucket refilled at Rate tokens per second and holding at most Burst tokens
+type Limit struct {
+	Rate  float64 `json:"rate" yaml:"rate"`
+	Burst int     `json:"burst" yaml:"burst"`
+}
+
+// Validate checks that the bucket refills and can hold at least one token
+func (l Limit) Validate() error {
+	if l.Rate <= 0 || l.Burst < 1 {
+		return fmt.Errorf("%w: rate must be positive and burst at least 1, got rate %v burst %d",
+			ErrInvalidLimit, l.Rate, l.Burst)
+	}
+	return nil
+}
+
+// Request asks for one token of the bucket identified by Key
+type Request struct {
+	Key   string
+	Limit Limit
+}
+
+// Limiter takes tokens from buckets kept in memory or in a store shared by several producers
+type Limiter interface {
+	// Allow takes one token from every requested bucket, or from none of them when one is empty
+	// Returns zero when the tokens were taken, otherwise how long until they all have one
+	Allow(requests ...Request) (time.Duration, error)
+	Close() error
+}
+
+// Config selects and configures a limiter backend
+type Config struct {
+	Backend string
+	Source  string // SQLite database path, shared by the producers of the host
+}
+
+// Open creates the limiter for the given backend
+func Open(config Config) (Limiter, error) {
+	switch config.Backend {
+	case BackendMemory, "":
+		return NewMemoryLimiter(), nil
+	case BackendSQLite:
+		return OpenSQLiteLimiter(config.Source)
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrUnknownBackend, config.Backend)
+	}
+}
+
+// bucket is the state of a token bucket at a point in time
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// refill returns the bucket at now, with the tokens added since it was last updated
+// A missing bucket (zero update time) starts full
+func (b bucket) refill(limit Limit, now time.Time) bucket {
+	if b.updated.IsZero() {
+		return bucket{tokens: float64(limit.Burst), updated: now}
+	}
+	if elapsed := now.Sub(b.updated).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(float64(limit.Burst), b.tokens+elapsed*limit.Rate)
+	}
+	b.updated = now
+	return b
+}
+
+// wait returns how long until the bucket holds a whole token, zero when it already does
+func (b bucket) wait(limit Limit) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// fullAt returns when the bucket is full again, it can be forgotten after that
+func (b bucket) fullAt(limit Limit) time.Time {
+	missing := float64(limit.Burst) - b.tokens
+	return b.updated.Add(time.Duration(missing / limit.Rate * float64(time.Second)))
+}
+
+// take refills the buckets and takes a token from each of them when they all have one
+// Returns the updated buckets, or the longest wait when one of them is empty
+func take(buckets []bucket, requests []Request, now time.Time) ([]bucket, time.Duration) {
+	var wait time.Duration
+	for i, request := range requests {
+		buckets[i] = buckets[i].refill(request.Limit, now)
+		wait = max(wait, buckets[i].wait(request.Limit))
+	}
+	if wait > 0 {
+		return buckets, wait
+	}
+	for i := range buckets {
+		buckets[i].tokens--
+	}
+	return buckets, 0
+}
@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteSchema creates the bucket table when the database is new
+// Times are unix nanoseconds; full_at is when a bucket can be deleted
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS rate_buckets (
+	key        TEXT PRIMARY KEY,
+	tokens     REAL NOT NULL,
+	updated_at INTEGER NOT NULL,
+	full_at    INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS rate_buckets_full_at ON rate_buckets (full_at);`
+
+// SQLiteLimiter keeps the buckets in a SQLite database so every producer opening
+// the same file shares the limits
+// Each Allow runs in an immediate transaction, serializing the producers
+type SQLiteLimiter struct {
+	db *sql.DB
+
+	mu        sync.Mutex
+	lastSweep time.Time
+}
+
+// OpenSQLiteLimiter opens or creates the bucket database at path
+func OpenSQLiteLimiter(path string) (*SQLiteLimiter, error) {
+	if path == "" {
+		return nil, errors.New("sqlite rate limiter needs a database path")
+	}
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL")
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rate limit database %s: %w", path, err)
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create rate limit database schema: %w", err)
+	}
+	return &SQLiteLimiter{db: db, lastSweep: time.Now()}, nil
+}
+
+// Allow takes one token from every requested bucket, or from none of them when one is empty
+func (l *SQLiteLimiter) Allow(requests ...Request) (time.Duration, error) {
+	for _, request := range requests {
+		if err := request.Limit.Validate(); err != nil {
+			return 0, err
+		}
+	}
+	tx, err := l.db.Begin()
+	if err != nil {
+		return 0, fmt.Errorf("failed to begin rate limit transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+	buckets := make([]bucket, len(requests))
+	for i, request := range requests {
+		var tokens float64
+		var updated int64
+		err := tx.QueryRow(`SELECT tokens, updated_at FROM rate_buckets WHERE key = ?`, request.Key).
+			Scan(&tokens, &updated)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+		case err != nil:
+			return 0, fmt.Errorf("failed to read rate limit bucket %s: %w", request.Key, err)
+		default:
+			buckets[i] = bucket{tokens: tokens, updated: time.Unix(0, updated)}
+		}
+	}
+	buckets, wait := take(buckets, requests, now)
+	if wait > 0 {
+		return wait, nil
+	}
+
+	for i, request := range requests {
+		_, err := tx.Exec(`INSERT INTO rate_buckets (key, tokens, updated_at, full_at) VALUES (?, ?, ?, ?)
+			ON CONFLICT (key) DO UPDATE SET tokens = excluded.tokens, updated_at = excluded.updated_at,
+			full_at = excluded.full_at`,
+			request.Key, buckets[i].tokens, buckets[i].updated.UnixNano(), buckets[i].fullAt(request.Limit).UnixNano())
+		if err != nil {
+			return 0, fmt.Errorf("failed to update rate limit bucket %s: %w", request.Key, err)
+		}
+	}
+	// Forget the buckets that are full again, they start full when used next
+	if l.sweepDue(now) {
+		if _, err := tx.Exec(`DELETE FROM rate_buckets WHERE full_at <= ?`, now.UnixNano()); err != nil {
+			return 0, fmt.Errorf("failed to sweep rate limit buckets: %w", err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, fmt.Errorf("failed to commit rate limit transaction: %w", err)
+	}
+	return 0, nil
+}
+
+// sweepDue reports whether it is time to delete the full buckets, at most once per sweepInterval
+func (l *SQLiteLimiter) sweepDue(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.lastSweep) < sweepInterval {
+		return false
+	}
+	l.lastSweep = now
+	return true
+}
+
+// Close closes the database
+func (l *SQLiteLimiter) Close() error {
+	return l.db.Close()
+}
@@ -0,0 +1,39 @@
+package ratelimit_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"kafka-notify/pkg/ratelimit"
+	"kafka-notify/pkg/ratelimit/limitertest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSQLiteLimiter(t *testing.T) {
+	limitertest.Run(t, func(t *testing.T) ratelimit.Limiter {
+		l, err := ratelimit.OpenSQLiteLimiter(filepath.Join(t.TempDir(), "limits.db"))
+		require.NoError(t, err)
+		return l
+	})
+}
+
+func TestSQLiteLimiterSharesBuckets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limits.db")
+	first, err := ratelimit.OpenSQLiteLimiter(path)
+	require.NoError(t, err)
+	defer first.Close()
+	second, err := ratelimit.OpenSQLiteLimiter(path)
+	require.NoError(t, err)
+	defer second.Close()
+
+	limit := ratelimit.Request{Key: "sender:1", Limit: ratelimit.Limit{Rate: 0.001, Burst: 1}}
+	wait, err := first.Allow(limit)
+	require.NoError(t, err)
+	assert.Zero(t, wait)
+	// The other producer sees the token taken by the first one
+	wait, err = second.Allow(limit)
+	require.NoError(t, err)
+	assert.Positive(t, wait)
+}
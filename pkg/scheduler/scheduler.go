@@ -0,0 +1,310 @@
+package scheduler
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"kafka-notify/pkg/models"
+
+	"github.com/alejoacosta74/go-logger"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// scheduledBucket holds the scheduled notifications keyed by notification ID
+	scheduledBucket = []byte("scheduled")
+	// dueBucket indexes the scheduled notifications by delivery time:
+	// big-endian unix nanoseconds followed by the notification ID
+	dueBucket = []byte("due")
+)
+
+const (
+	// idleWait is how long the scheduler sleeps when nothing is scheduled
+	idleWait = time.Minute
+	// retryDelay is the wait before retrying a notification that failed to publish
+	retryDelay = 5 * time.Second
+)
+
+// ErrNotScheduled is returned when a notification is not scheduled, because it
+// was cancelled, already delivered or never existed
+var ErrNotScheduled = errors.New("notification is not scheduled")
+
+// Scheduled is a notification waiting for its delivery time
+type Scheduled struct {
+	ID           string              `json:"id"`
+	DeliverAt    time.Time           `json:"deliverAt"`
+	ScheduledAt  time.Time           `json:"scheduledAt"`
+	Notification models.Notification `json:"notification"`
+}
+
+// PublishFunc hands a due notification over to Kafka
+// When it fails the notification stays scheduled and is retried
+type PublishFunc func(notification models.Notification) error
+
+// Scheduler keeps notifications in an embedded bbolt database until they are due
+// Scheduled notifications survive restarts, the ones that became due while the
+// producer was down are published as soon as it starts again
+type Scheduler struct {
+	db      *bolt.DB
+	publish PublishFunc
+	// wake interrupts the wait when an earlier notification is scheduled
+	wake chan struct{}
+	// mu serializes publishing with cancel and reschedule, so a notification
+	// being published cannot be cancelled at the same time
+	mu sync.Mutex
+}
+
+// Open opens (or creates) the scheduler database file at path
+func Open(path string, publish PublishFunc) (*Scheduler, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open scheduler %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{scheduledBucket, dueBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize scheduler: %w", err)
+	}
+	return &Scheduler{db: db, publish: publish, wake: make(chan struct{}, 1)}, nil
+}
+
+// Schedule stores a notification to be published at deliverAt
+func (s *Scheduler) Schedule(notification models.Notification, deliverAt time.Time) (Scheduled, error) {
+	scheduled := Scheduled{
+		ID:           notification.ID,
+		DeliverAt:    deliverAt.UTC(),
+		ScheduledAt:  time.Now().UTC(),
+		Notification: notification,
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		return putScheduled(tx, scheduled)
+	})
+	if err != nil {
+		return Scheduled{}, fmt.Errorf("failed to schedule notification %s: %w", notification.ID, err)
+	}
+	s.signal()
+	logger.Info("Notification scheduled", "id", scheduled.ID, "deliverAt", scheduled.DeliverAt.Format(time.RFC3339))
+	return scheduled, nil
+}
+
+// Get returns a scheduled notification
+func (s *Scheduler) Get(id string) (Scheduled, error) {
+	var scheduled Scheduled
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		scheduled, err = getScheduled(tx, id)
+		return err
+	})
+	return scheduled, err
+}
+
+// List returns up to limit scheduled notifications, earliest delivery first
+// A limit of 0 returns every scheduled notification
+func (s *Scheduler) List(limit int) ([]Scheduled, error) {
+	var list []Scheduled
+	err := s.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(dueBucket).Cursor()
+		for k, _ := cursor.First(); k != nil && (limit <= 0 || len(list) < limit); k, _ = cursor.Next() {
+			scheduled, err := getScheduled(tx, string(k[8:]))
+			if err != nil {
+				return err
+			}
+			list = append(list, scheduled)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list scheduled notifications: %w", err)
+	}
+	return list, nil
+}
+
+// Cancel removes a scheduled notification so it is never published
+func (s *Scheduler) Cancel(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		scheduled, err := getScheduled(tx, id)
+		if err != nil {
+			return err
+		}
+		return deleteScheduled(tx, scheduled)
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Scheduled notification cancelled", "id", id)
+	return nil
+}
+
+// Reschedule moves a scheduled notification to a new delivery time
+func (s *Scheduler) Reschedule(id string, deliverAt time.Time) (Scheduled, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var scheduled Scheduled
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if scheduled, err = getScheduled(tx, id); err != nil {
+			return err
+		}
+		if err := deleteScheduled(tx, scheduled); err != nil {
+			return err
+		}
+		scheduled.DeliverAt = deliverAt.UTC()
+		return putScheduled(tx, scheduled)
+	})
+	if err != nil {
+		return Scheduled{}, err
+	}
+	s.signal()
+	logger.Info("Notification rescheduled", "id", id, "deliverAt", scheduled.DeliverAt.Format(time.RFC3339))
+	return scheduled, nil
+}
+
+// Run publishes the notifications as they become due until the context is cancelled
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		wait := idleWait
+		next, err := s.publishDue(ctx, time.Now())
+		switch {
+		case err != nil:
+			logger.Error("Failed to publish scheduled notification, retrying", "error", err)
+			wait = retryDelay
+		case !next.IsZero():
+			wait = time.Until(next)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// publishDue publishes every notification due at now, earliest first
+// Returns the delivery time of the next scheduled notification, zero when there is none
+// Stops between notifications when the context is cancelled, the rest stay scheduled
+func (s *Scheduler) publishDue(ctx context.Context, now time.Time) (time.Time, error) {
+	for {
+		if ctx.Err() != nil {
+			return time.Time{}, nil
+		}
+		next, done, err := s.publishNext(now)
+		if err != nil || done {
+			return next, err
+		}
+	}
+}
+
+// publishNext publishes the earliest notification if it is due
+// A crash after publishing and before deleting it publishes it again on restart,
+// consumers drop the duplicate by notification ID
+func (s *Scheduler) publishNext(now time.Time) (time.Time, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var scheduled Scheduled
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(dueBucket).Cursor().First()
+		if k == nil {
+			return ErrNotScheduled
+		}
+		var err error
+		scheduled, err = getScheduled(tx, string(k[8:]))
+		return err
+	})
+	if errors.Is(err, ErrNotScheduled) {
+		return time.Time{}, true, nil
+	}
+	if err != nil {
+		return time.Time{}, true, err
+	}
+	if scheduled.DeliverAt.After(now) {
+		return scheduled.DeliverAt, true, nil
+	}
+
+	if err := s.publish(scheduled.Notification); err != nil {
+		return time.Time{}, true, fmt.Errorf("failed to publish %s: %w", scheduled.ID, err)
+	}
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		return deleteScheduled(tx, scheduled)
+	})
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("failed to remove published notification %s: %w", scheduled.ID, err)
+	}
+	logger.Info("Scheduled notification published", "id", scheduled.ID,
+		"late", now.Sub(scheduled.DeliverAt).Round(time.Millisecond).String())
+	return time.Time{}, false, nil
+}
+
+// Close closes the database
+func (s *Scheduler) Close() error {
+	return s.db.Close()
+}
+
+// signal wakes the run loop without blocking when it was already woken
+func (s *Scheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// putScheduled stores a notification and indexes it by delivery time
+func putScheduled(tx *bolt.Tx, scheduled Scheduled) error {
+	data, err := json.Marshal(scheduled)
+	if err != nil {
+		return err
+	}
+	if err := tx.Bucket(scheduledBucket).Put([]byte(scheduled.ID), data); err != nil {
+		return err
+	}
+	return tx.Bucket(dueBucket).Put(dueKey(scheduled), nil)
+}
+
+// getScheduled loads a scheduled notification by ID
+func getScheduled(tx *bolt.Tx, id string) (Scheduled, error) {
+	data := tx.Bucket(scheduledBucket).Get([]byte(id))
+	if data == nil {
+		return Scheduled{}, fmt.Errorf("%w: %s", ErrNotScheduled, id)
+	}
+	var scheduled Scheduled
+	if err := json.Unmarshal(data, &scheduled); err != nil {
+		return Scheduled{}, fmt.Errorf("failed to decode scheduled notification %s: %w", id, err)
+	}
+	return scheduled, nil
+}
+
+// deleteScheduled removes a notification and its delivery time index entry
+func deleteScheduled(tx *bolt.Tx, scheduled Scheduled) error {
+	if err := tx.Bucket(dueBucket).Delete(dueKey(scheduled)); err != nil {
+		return err
+	}
+	return tx.Bucket(scheduledBucket).Delete([]byte(scheduled.ID))
+}
+
+// dueKey builds the index key of a notification, ordered by delivery time then ID
+func dueKey(scheduled Scheduled) []byte {
+	key := make([]byte, 8, 8+len(scheduled.ID))
+	binary.BigEndian.PutUint64(key, uint64(scheduled.DeliverAt.UnixNano()))
+	return append(key, scheduled.ID...)
+}
@@ -0,0 +1,43 @@
+package scheduler
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"kafka-notify/pkg/models"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublishDueStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var published []string
+	// The producer is closed once the context is cancelled, nothing may be published after
+	publish := func(notification models.Notification) error {
+		require.NoError(t, ctx.Err(), "published %s after cancellation", notification.ID)
+		published = append(published, notification.ID)
+		cancel()
+		return nil
+	}
+	s, err := Open(filepath.Join(t.TempDir(), "scheduler.db"), publish)
+	require.NoError(t, err)
+	t.Cleanup(func() { assert.NoError(t, s.Close()) })
+
+	past := time.Now().Add(-time.Minute)
+	for i, id := range []string{"a", "b", "c"} {
+		_, err := s.Schedule(models.Notification{ID: id}, past.Add(time.Duration(i)*time.Second))
+		require.NoError(t, err)
+	}
+
+	_, err = s.publishDue(ctx, time.Now())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a"}, published)
+
+	// The notifications not published stay scheduled for the next run
+	remaining, err := s.List(0)
+	require.NoError(t, err)
+	assert.Len(t, remaining, 2)
+}
@@ -5,6 +5,8 @@ import (
 	"net/http"
 	"time"
 
+	"kafka-notify/pkg/metrics"
+
 	"github.com/alejoacosta74/go-logger"
 	"github.com/gin-gonic/gin"
 )
@@ -18,6 +20,9 @@ func NewServer(port string) *Server {
 	gin.SetMode(gin.ReleaseMode)
 	// Create default Gin router with middleware
 	router := gin.Default()
+	// Measure every request and expose the metrics to Prometheus
+	router.Use(metrics.Middleware())
+	router.GET("/metrics", metrics.Handler())
 	return &Server{
 		Server: &http.Server{
 			Addr:    port,
@@ -26,6 +31,10 @@ func NewServer(port string) *Server {
 	}
 }
 
+func (s Server) Use(middleware ...gin.HandlerFunc) {
+	s.Server.Handler.(*gin.Engine).Use(middleware...)
+}
+
 func (s Server) Get(relativePath string, handlers ...gin.HandlerFunc) {
 	s.Server.Handler.(*gin.Engine).GET(relativePath, handlers...)
 }
@@ -34,6 +43,14 @@ func (s Server) Post(relativePath string, handlers ...gin.HandlerFunc) {
 	s.Server.Handler.(*gin.Engine).POST(relativePath, handlers...)
 }
 
+func (s Server) Put(relativePath string, handlers ...gin.HandlerFunc) {
+	s.Server.Handler.(*gin.Engine).PUT(relativePath, handlers...)
+}
+
+func (s Server) Delete(relativePath string, handlers ...gin.HandlerFunc) {
+	s.Server.Handler.(*gin.Engine).DELETE(relativePath, handlers...)
+}
+
 func (s Server) ListenAndServe() {
 	go func() {
 		if err := s.Server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -43,7 +60,8 @@ func (s Server) ListenAndServe() {
 }
 
 func (s Server) Shutdown(ctx context.Context) {
-	ctxWithTimeout, _ := context.WithTimeout(ctx, 5*time.Second)
+	ctxWithTimeout, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
 	if err := s.Server.Shutdown(ctxWithTimeout); err != nil {
 		logger.Error("server forced to shutdown", "error", err)
 	}
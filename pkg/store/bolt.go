@@ -0,0 +1,338 @@
+package store
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"kafka-notify/pkg/models"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// usersBucket holds one nested bucket per user, keyed by sequence number
+	usersBucket = []byte("users")
+	// offsetsBucket holds the last processed offset per topic partition
+	offsetsBucket = []byte("offsets")
+)
+
+// BoltStore is a durable store backed by an embedded bbolt database file
+// Notifications survive restarts and every write is fsynced before returning
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore opens (or creates) the database file at path
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open bolt store %s: %w", path, err)
+	}
+	// Create the top level buckets up front so reads never have to
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{usersBucket, offsetsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialize bolt store: %w", err)
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Add appends a notification to the user's bucket
+func (bs *BoltStore) Add(userID string,
+	notification models.Notification) (StoredNotification, error) {
+	var stored StoredNotification
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		stored, err = addNotification(tx, userID, notification)
+		return err
+	})
+	return stored, err
+}
+
+// AddAt appends a notification and records its Kafka position in the same transaction,
+// so the checkpoint never gets ahead of or behind the stored data
+func (bs *BoltStore) AddAt(userID string, notification models.Notification,
+	pos Position) (StoredNotification, error) {
+	var stored StoredNotification
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		if stored, err = addNotification(tx, userID, notification); err != nil {
+			return err
+		}
+		return tx.Bucket(offsetsBucket).Put(offsetKey(pos.Topic, pos.Partition), itob(uint64(pos.Offset)))
+	})
+	return stored, err
+}
+
+// SetCheckpoint records pos as the last processed offset of its topic partition
+func (bs *BoltStore) SetCheckpoint(pos Position) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(offsetsBucket).Put(offsetKey(pos.Topic, pos.Partition), itob(uint64(pos.Offset)))
+	})
+}
+
+// Checkpoint returns the last offset recorded for the topic partition
+func (bs *BoltStore) Checkpoint(topic string, partition int32) (int64, bool, error) {
+	var (
+		offset int64
+		ok     bool
+	)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(offsetsBucket).Get(offsetKey(topic, partition))
+		if value == nil {
+			return nil
+		}
+		offset, ok = int64(binary.BigEndian.Uint64(value)), true
+		return nil
+	})
+	return offset, ok, err
+}
+
+// List returns all the user's notifications ordered by sequence number
+func (bs *BoltStore) List(userID string) ([]StoredNotification, error) {
+	return bs.Since(userID, 0)
+}
+
+// Since returns the user's notifications with a sequence number greater than seq
+func (bs *BoltStore) Since(userID string, seq int) ([]StoredNotification, error) {
+	var notes []StoredNotification
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		// Keys are big endian sequence numbers, so cursor order is sequence order
+		cursor := bucket.Cursor()
+		for key, value := cursor.Seek(itob(uint64(seq) + 1)); key != nil; key, value = cursor.Next() {
+			var note StoredNotification
+			if err := json.Unmarshal(value, &note); err != nil {
+				return fmt.Errorf("failed to decode notification %d: %w", btoi(key), err)
+			}
+			notes = append(notes, note)
+		}
+		return nil
+	})
+	return notes, err
+}
+
+// Count returns how many notifications the user has
+func (bs *BoltStore) Count(userID string) (int, error) {
+	count := 0
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		count = bucket.Stats().KeyN
+		return nil
+	})
+	return count, err
+}
+
+// Delete removes a single notification from the user's bucket
+func (bs *BoltStore) Delete(userID string, seq int) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if bucket == nil || bucket.Get(itob(uint64(seq))) == nil {
+			return ErrNotFound
+		}
+		return bucket.Delete(itob(uint64(seq)))
+	})
+}
+
+// MarkRead flags the given notifications as read
+func (bs *BoltStore) MarkRead(userID string, seqs ...int) (int, error) {
+	changed := 0
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		for _, seq := range seqs {
+			key := itob(uint64(seq))
+			value := bucket.Get(key)
+			if value == nil {
+				continue
+			}
+			var note StoredNotification
+			if err := json.Unmarshal(value, &note); err != nil {
+				return fmt.Errorf("failed to decode notification %d: %w", seq, err)
+			}
+			if note.Read {
+				continue
+			}
+			note.Read = true
+			if err := putNotification(bucket, note); err != nil {
+				return err
+			}
+			changed++
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// MarkReadUpTo flags every notification up to the given sequence number as read
+func (bs *BoltStore) MarkReadUpTo(userID string, seq int) (int, error) {
+	changed := 0
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		// Collect first, bolt cursors must not be used while the bucket is modified
+		var updated []StoredNotification
+		cursor := bucket.Cursor()
+		for key, value := cursor.First(); key != nil && btoi(key) <= uint64(seq); key, value = cursor.Next() {
+			var note StoredNotification
+			if err := json.Unmarshal(value, &note); err != nil {
+				return fmt.Errorf("failed to decode notification %d: %w", btoi(key), err)
+			}
+			if !note.Read {
+				note.Read = true
+				updated = append(updated, note)
+			}
+		}
+		for _, note := range updated {
+			if err := putNotification(bucket, note); err != nil {
+				return err
+			}
+		}
+		changed = len(updated)
+		return nil
+	})
+	return changed, err
+}
+
+// UnreadCount returns how many of the user's notifications are unread
+func (bs *BoltStore) UnreadCount(userID string) (int, error) {
+	unread := 0
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(usersBucket).Bucket([]byte(userID))
+		if bucket == nil {
+			return nil
+		}
+		return bucket.ForEach(func(key, value []byte) error {
+			var note StoredNotification
+			if err := json.Unmarshal(value, &note); err != nil {
+				return fmt.Errorf("failed to decode notification %d: %w", btoi(key), err)
+			}
+			if !note.Read {
+				unread++
+			}
+			return nil
+		})
+	})
+	return unread, err
+}
+
+// Usage counts the users with notifications, the bytes are the size of the database file
+func (bs *BoltStore) Usage() (Usage, error) {
+	var usage Usage
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		usage.Bytes = tx.Size()
+		return users.ForEachBucket(func(userID []byte) error {
+			if count := users.Bucket(userID).Stats().KeyN; count > 0 {
+				usage.Users++
+				usage.Notifications += count
+			}
+			return nil
+		})
+	})
+	return usage, err
+}
+
+// Prune evicts the notifications that violate the retention policy in a single transaction
+// The global budget is measured with the encoded size of the notifications on disk
+func (bs *BoltStore) Prune(policy RetentionPolicy, now time.Time) (EvictionStats, error) {
+	var stats EvictionStats
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		users := tx.Bucket(usersBucket)
+		data := make(map[string][]StoredNotification)
+		sizes := make(map[eviction]int64)
+		err := users.ForEachBucket(func(userID []byte) error {
+			return users.Bucket(userID).ForEach(func(key, value []byte) error {
+				var note StoredNotification
+				if err := json.Unmarshal(value, &note); err != nil {
+					return fmt.Errorf("failed to decode notification %d: %w", btoi(key), err)
+				}
+				data[string(userID)] = append(data[string(userID)], note)
+				sizes[eviction{userID: string(userID), seq: note.Seq}] = int64(len(key) + len(value))
+				return nil
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		var evictions []eviction
+		evictions, stats = selectEvictions(data, func(userID string, note StoredNotification) int64 {
+			return sizes[eviction{userID: userID, seq: note.Seq}]
+		}, policy, now)
+		for _, ev := range evictions {
+			if err := users.Bucket([]byte(ev.userID)).Delete(itob(uint64(ev.seq))); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// Close closes the database file
+func (bs *BoltStore) Close() error {
+	return bs.db.Close()
+}
+
+// addNotification stores a notification under the next sequence number of the user's bucket
+func addNotification(tx *bolt.Tx, userID string,
+	notification models.Notification) (StoredNotification, error) {
+	bucket, err := tx.Bucket(usersBucket).CreateBucketIfNotExists([]byte(userID))
+	if err != nil {
+		return StoredNotification{}, fmt.Errorf("failed to create bucket for user %s: %w", userID, err)
+	}
+	// NextSequence never reuses a value, even after deletes
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return StoredNotification{}, err
+	}
+	stored := StoredNotification{Seq: int(seq), StoredAt: time.Now(), Notification: notification}
+	return stored, putNotification(bucket, stored)
+}
+
+// putNotification encodes and writes a notification under its sequence number
+func putNotification(bucket *bolt.Bucket, note StoredNotification) error {
+	value, err := json.Marshal(note)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	return bucket.Put(itob(uint64(note.Seq)), value)
+}
+
+// offsetKey builds the offsets bucket key for a topic partition
+func offsetKey(topic string, partition int32) []byte {
+	return []byte(topic + "/" + strconv.Itoa(int(partition)))
+}
+
+// itob encodes a number as a sortable big endian key
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// btoi decodes a big endian key
+func btoi(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
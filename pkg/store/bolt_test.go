@@ -0,0 +1,19 @@
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"kafka-notify/pkg/store"
+	"kafka-notify/pkg/store/storetest"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBoltStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		s, err := store.NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+		require.NoError(t, err)
+		return s
+	})
+}
@@ -0,0 +1,90 @@
+package store
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/alejoacosta74/go-logger"
+)
+
+// JanitorStats reports the work done by a janitor since it started
+type JanitorStats struct {
+	Policy    RetentionPolicy `json:"policy"`
+	Runs      int             `json:"runs"`
+	Failures  int             `json:"failures"`
+	Evictions EvictionStats   `json:"evictions"`
+	LastRun   time.Time       `json:"lastRun"`
+}
+
+// DefaultJanitorInterval is how often a janitor prunes when no valid interval is given
+const DefaultJanitorInterval = time.Minute
+
+// Janitor periodically enforces a retention policy on a store
+type Janitor struct {
+	pruner   Pruner
+	policy   RetentionPolicy
+	interval time.Duration
+
+	mu    sync.Mutex
+	stats JanitorStats
+}
+
+// NewJanitor creates a janitor that prunes the store every interval
+// A non-positive interval falls back to DefaultJanitorInterval
+func NewJanitor(pruner Pruner, policy RetentionPolicy, interval time.Duration) *Janitor {
+	if interval <= 0 {
+		logger.Warn("Invalid retention interval, using the default", "interval", interval,
+			"default", DefaultJanitorInterval)
+		interval = DefaultJanitorInterval
+	}
+	return &Janitor{
+		pruner:   pruner,
+		policy:   policy,
+		interval: interval,
+		stats:    JanitorStats{Policy: policy},
+	}
+}
+
+// Run prunes the store until the context is cancelled
+func (j *Janitor) Run(ctx context.Context) {
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			j.prune(now)
+		}
+	}
+}
+
+// Stats returns a snapshot of the janitor counters
+func (j *Janitor) Stats() JanitorStats {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.stats
+}
+
+// prune runs a single retention pass and records its outcome
+func (j *Janitor) prune(now time.Time) {
+	evicted, err := j.pruner.Prune(j.policy, now)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.stats.Runs++
+	j.stats.LastRun = now
+	if err != nil {
+		j.stats.Failures++
+		logger.Error("Failed to enforce retention policy", "error", err)
+		return
+	}
+	j.stats.Evictions.ByCount += evicted.ByCount
+	j.stats.Evictions.ByAge += evicted.ByAge
+	j.stats.Evictions.ByBudget += evicted.ByBudget
+	if evicted.Total() > 0 {
+		logger.Info("Evicted notifications", "byCount", evicted.ByCount,
+			"byAge", evicted.ByAge, "byBudget", evicted.ByBudget)
+	}
+}
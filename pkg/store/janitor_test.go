@@ -0,0 +1,46 @@
+package store_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"kafka-notify/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// countingPruner counts the retention passes run against it
+type countingPruner struct {
+	mu   sync.Mutex
+	runs int
+}
+
+func (p *countingPruner) Prune(store.RetentionPolicy, time.Time) (store.EvictionStats, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.runs++
+	return store.EvictionStats{}, nil
+}
+
+func TestJanitorPrunesEveryInterval(t *testing.T) {
+	pruner := &countingPruner{}
+	janitor := store.NewJanitor(pruner, store.RetentionPolicy{MaxPerUser: 1}, 10*time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	janitor.Run(ctx)
+	assert.Positive(t, janitor.Stats().Runs)
+}
+
+func TestJanitorRejectsNonPositiveInterval(t *testing.T) {
+	for _, interval := range []time.Duration{0, -time.Second} {
+		janitor := store.NewJanitor(&countingPruner{}, store.RetentionPolicy{MaxPerUser: 1}, interval)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		// Falls back to the default interval instead of panicking in time.NewTicker
+		assert.NotPanics(t, func() { janitor.Run(ctx) }, "interval %s", interval)
+		cancel()
+		assert.Zero(t, janitor.Stats().Runs, "the default interval is not reached")
+	}
+}
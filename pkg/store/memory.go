@@ -0,0 +1,195 @@
+package store
+
+import (
+	"sync"
+	"time"
+
+	"kafka-notify/pkg/models"
+)
+
+// UserNotifications is a custom type that maps user IDs to their slice of notifications
+// This allows efficient storage and retrieval of notifications per user
+type UserNotifications map[string][]StoredNotification
+
+// MemoryStore provides thread-safe in-memory storage of user notifications
+// Uses a mutex to safely handle concurrent access to the data
+type MemoryStore struct {
+	data    UserNotifications // Holds the actual notification data
+	lastSeq map[string]int    // Last sequence number assigned per user
+	mu      sync.RWMutex      // RWMutex allows multiple readers but only one writer
+}
+
+// NewMemoryStore creates an empty in-memory store
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		data:    make(UserNotifications),
+		lastSeq: make(map[string]int),
+	}
+}
+
+// Add safely adds a new notification to a user's notification list
+// Uses a write lock to ensure thread-safe updates to the data
+func (ms *MemoryStore) Add(userID string,
+	notification models.Notification) (StoredNotification, error) {
+	ms.mu.Lock()         // Acquire exclusive write lock
+	defer ms.mu.Unlock() // Release lock when function returns
+
+	ms.lastSeq[userID]++
+	stored := StoredNotification{
+		Seq:          ms.lastSeq[userID],
+		StoredAt:     time.Now(),
+		Notification: notification,
+	}
+	ms.data[userID] = append(ms.data[userID], stored) // Append new notification to user's list
+	return stored, nil
+}
+
+// List safely retrieves all notifications for a given user
+// Uses a read lock since it's not modifying data
+func (ms *MemoryStore) List(userID string) ([]StoredNotification, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	// Copy so callers never share the backing array with the store
+	return append([]StoredNotification(nil), ms.data[userID]...), nil
+}
+
+// Since safely retrieves the notifications stored after the given sequence number
+func (ms *MemoryStore) Since(userID string, seq int) ([]StoredNotification, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	notes := ms.data[userID]
+	// Notifications are ordered by sequence number, skip the ones already seen
+	i := 0
+	for i < len(notes) && notes[i].Seq <= seq {
+		i++
+	}
+	return append([]StoredNotification(nil), notes[i:]...), nil
+}
+
+// Count returns how many notifications a user has
+func (ms *MemoryStore) Count(userID string) (int, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return len(ms.data[userID]), nil
+}
+
+// Delete removes a single notification from a user's list
+func (ms *MemoryStore) Delete(userID string, seq int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	notes := ms.data[userID]
+	for i, note := range notes {
+		if note.Seq == seq {
+			ms.data[userID] = append(notes[:i:i], notes[i+1:]...)
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// MarkRead flags the given notifications as read
+func (ms *MemoryStore) MarkRead(userID string, seqs ...int) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	wanted := make(map[int]bool, len(seqs))
+	for _, seq := range seqs {
+		wanted[seq] = true
+	}
+	changed := 0
+	notes := ms.data[userID]
+	for i := range notes {
+		if wanted[notes[i].Seq] && !notes[i].Read {
+			notes[i].Read = true
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// MarkReadUpTo flags every notification up to the given sequence number as read
+func (ms *MemoryStore) MarkReadUpTo(userID string, seq int) (int, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	changed := 0
+	notes := ms.data[userID]
+	for i := range notes {
+		if notes[i].Seq > seq {
+			break
+		}
+		if !notes[i].Read {
+			notes[i].Read = true
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// UnreadCount returns how many of a user's notifications are unread
+func (ms *MemoryStore) UnreadCount(userID string) (int, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	unread := 0
+	for _, note := range ms.data[userID] {
+		if !note.Read {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+// Usage counts the users with notifications and estimates the memory they use
+func (ms *MemoryStore) Usage() (Usage, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	var usage Usage
+	for userID, notes := range ms.data {
+		if len(notes) == 0 {
+			continue
+		}
+		usage.Users++
+		usage.Notifications += len(notes)
+		for _, note := range notes {
+			usage.Bytes += approxSize(userID, note)
+		}
+	}
+	return usage, nil
+}
+
+// Prune evicts the notifications that violate the retention policy
+// The global budget is measured with an estimate of the memory used per notification
+func (ms *MemoryStore) Prune(policy RetentionPolicy, now time.Time) (EvictionStats, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	evictions, stats := selectEvictions(ms.data, approxSize, policy, now)
+	if len(evictions) == 0 {
+		return stats, nil
+	}
+
+	evicted := make(map[string]map[int]bool)
+	for _, ev := range evictions {
+		if evicted[ev.userID] == nil {
+			evicted[ev.userID] = make(map[int]bool)
+		}
+		evicted[ev.userID][ev.seq] = true
+	}
+	for userID, seqs := range evicted {
+		// Rebuild the list so the evicted notifications can be garbage collected
+		remaining := make([]StoredNotification, 0, len(ms.data[userID])-len(seqs))
+		for _, note := range ms.data[userID] {
+			if !seqs[note.Seq] {
+				remaining = append(remaining, note)
+			}
+		}
+		if len(remaining) == 0 {
+			// Keep lastSeq so sequence numbers are never reused
+			delete(ms.data, userID)
+			continue
+		}
+		ms.data[userID] = remaining
+	}
+	return stats, nil
+}
+
+// Close is a no-op for the in-memory store
+func (ms *MemoryStore) Close() error { return nil }
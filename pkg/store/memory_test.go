@@ -0,0 +1,14 @@
+package store_test
+
+import (
+	"testing"
+
+	"kafka-notify/pkg/store"
+	"kafka-notify/pkg/store/storetest"
+)
+
+func TestMemoryStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.NewMemoryStore()
+	})
+}
@@ -0,0 +1,124 @@
+package store
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"kafka-notify/pkg/models"
+)
+
+// Sort orders for a query
+const (
+	OrderAsc  = "asc"
+	OrderDesc = "desc"
+)
+
+// cursorPrefix versions the cursor format so it can evolve without breaking clients
+const cursorPrefix = "v1:"
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// Query selects and pages a user's notifications
+// Zero values disable the corresponding filter
+type Query struct {
+	Limit      int         // Maximum notifications returned, 0 returns all
+	After      int         // Only notifications with a greater sequence number
+	Before     int         // Only notifications with a smaller sequence number
+	Order      string      // OrderAsc (oldest first, default) or OrderDesc
+	FromID     int         // Only notifications sent by this user
+	Kind       models.Kind // Only notifications of this kind
+	Since      time.Time   // Only notifications created at or after this time
+	Until      time.Time   // Only notifications created before this time
+	UnreadOnly bool        // Only notifications not read yet
+}
+
+// Page is one page of query results
+// NextCursor is empty when there are no more results
+type Page struct {
+	Notifications []StoredNotification `json:"notifications"`
+	NextCursor    string               `json:"next_cursor,omitempty"`
+}
+
+// EncodeCursor turns a sequence number into an opaque pagination cursor
+func EncodeCursor(seq int) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursorPrefix + strconv.Itoa(seq)))
+}
+
+// DecodeCursor returns the sequence number held by a pagination cursor
+func DecodeCursor(cursor string) (int, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || !strings.HasPrefix(string(raw), cursorPrefix) {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	seq, err := strconv.Atoi(strings.TrimPrefix(string(raw), cursorPrefix))
+	if err != nil || seq < 0 {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidCursor, cursor)
+	}
+	return seq, nil
+}
+
+// Apply filters, sorts and pages notifications ordered by sequence number
+// The next cursor must be passed as After for ascending and Before for descending order
+func Apply(notes []StoredNotification, q Query) Page {
+	matched := make([]StoredNotification, 0, len(notes))
+	for _, note := range notes {
+		if q.matches(note) {
+			matched = append(matched, note)
+		}
+	}
+
+	if q.Order == OrderDesc {
+		sort.SliceStable(matched, func(i, j int) bool { return matched[i].Seq > matched[j].Seq })
+	}
+
+	page := Page{Notifications: matched}
+	if q.Limit > 0 && len(matched) > q.Limit {
+		page.Notifications = matched[:q.Limit]
+		page.NextCursor = EncodeCursor(page.Notifications[q.Limit-1].Seq)
+	}
+	return page
+}
+
+// matches reports whether a notification passes every filter of the query
+func (q Query) matches(note StoredNotification) bool {
+	switch {
+	case q.After > 0 && note.Seq <= q.After:
+		return false
+	case q.Before > 0 && note.Seq >= q.Before:
+		return false
+	case q.FromID != 0 && note.From.ID != q.FromID:
+		return false
+	case q.Kind != "" && note.kind() != q.Kind:
+		return false
+	case !q.Since.IsZero() && note.createdAt().Before(q.Since):
+		return false
+	case !q.Until.IsZero() && !note.createdAt().Before(q.Until):
+		return false
+	case q.UnreadOnly && note.Read:
+		return false
+	}
+	return true
+}
+
+// kind returns the notification kind, notifications stored before kinds existed are plain messages
+func (note StoredNotification) kind() models.Kind {
+	if note.Kind == "" {
+		return models.KindMessage
+	}
+	return note.Kind
+}
+
+// createdAt returns when the notification was created, falling back to when it
+// was stored for notifications saved before creation times were recorded
+func (note StoredNotification) createdAt() time.Time {
+	if note.CreatedAt.IsZero() {
+		return note.StoredAt
+	}
+	return note.CreatedAt
+}
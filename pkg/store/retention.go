@@ -0,0 +1,107 @@
+package store
+
+import (
+	"sort"
+	"time"
+)
+
+// notificationOverhead approximates the fixed bytes used by a stored notification
+// on top of its variable length strings
+const notificationOverhead = 64
+
+// RetentionPolicy limits how many notifications a store keeps
+// A zero value for any limit disables it
+type RetentionPolicy struct {
+	MaxPerUser int           `json:"maxPerUser"` // Notifications kept per user, newest first
+	MaxAge     time.Duration `json:"maxAge"`     // Notifications older than this are evicted
+	MaxBytes   int64         `json:"maxBytes"`   // Global budget across all users, oldest evicted first
+}
+
+// Enabled reports whether any limit is set
+func (p RetentionPolicy) Enabled() bool {
+	return p.MaxPerUser > 0 || p.MaxAge > 0 || p.MaxBytes > 0
+}
+
+// EvictionStats counts the notifications evicted by each limit of a policy
+type EvictionStats struct {
+	ByCount  int `json:"byCount"`
+	ByAge    int `json:"byAge"`
+	ByBudget int `json:"byBudget"`
+}
+
+// Total returns the number of evicted notifications
+func (s EvictionStats) Total() int {
+	return s.ByCount + s.ByAge + s.ByBudget
+}
+
+// Pruner is implemented by stores that can enforce a retention policy
+type Pruner interface {
+	// Prune evicts the notifications that violate the policy at the given time
+	Prune(policy RetentionPolicy, now time.Time) (EvictionStats, error)
+}
+
+// eviction identifies a notification selected for removal
+type eviction struct {
+	userID string
+	seq    int
+}
+
+// selectEvictions applies a policy to a snapshot of every user's notifications
+// sizeOf returns the bytes a user's notification uses in the backend
+// Notifications without a storage time are never evicted by age
+func selectEvictions(data map[string][]StoredNotification, sizeOf func(string, StoredNotification) int64,
+	policy RetentionPolicy, now time.Time) ([]eviction, EvictionStats) {
+	var (
+		evictions []eviction
+		stats     EvictionStats
+		kept      []eviction
+		keptNotes = make(map[eviction]StoredNotification)
+		totalSize int64
+	)
+
+	for userID, notes := range data {
+		// Notifications are ordered oldest first, the newest MaxPerUser survive
+		firstKept := 0
+		if policy.MaxPerUser > 0 && len(notes) > policy.MaxPerUser {
+			firstKept = len(notes) - policy.MaxPerUser
+		}
+		for i, note := range notes {
+			ev := eviction{userID: userID, seq: note.Seq}
+			switch {
+			case policy.MaxAge > 0 && !note.StoredAt.IsZero() && now.Sub(note.StoredAt) > policy.MaxAge:
+				evictions = append(evictions, ev)
+				stats.ByAge++
+			case i < firstKept:
+				evictions = append(evictions, ev)
+				stats.ByCount++
+			default:
+				kept = append(kept, ev)
+				keptNotes[ev] = note
+				totalSize += sizeOf(userID, note)
+			}
+		}
+	}
+
+	if policy.MaxBytes <= 0 || totalSize <= policy.MaxBytes {
+		return evictions, stats
+	}
+
+	// Over the global budget: evict the oldest remaining notifications across all users
+	sort.Slice(kept, func(i, j int) bool {
+		return keptNotes[kept[i]].StoredAt.Before(keptNotes[kept[j]].StoredAt)
+	})
+	for _, ev := range kept {
+		if totalSize <= policy.MaxBytes {
+			break
+		}
+		totalSize -= sizeOf(ev.userID, keptNotes[ev])
+		evictions = append(evictions, ev)
+		stats.ByBudget++
+	}
+	return evictions, stats
+}
+
+// approxSize estimates the memory used by a user's notification held in memory
+func approxSize(userID string, note StoredNotification) int64 {
+	return int64(notificationOverhead + len(userID) + len(note.Message) + len(note.From.Name) + len(note.To.Name))
+}
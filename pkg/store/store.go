@@ -0,0 +1,100 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"kafka-notify/pkg/models"
+)
+
+// Supported storage backends, selected with the --store flag
+const (
+	BackendMemory = "memory"
+	BackendBolt   = "bolt"
+)
+
+// ErrNotFound is returned when a notification does not exist in the store
+var ErrNotFound = errors.New("notification not found")
+
+// ErrUnknownBackend is returned when the configured storage backend is not supported
+var ErrUnknownBackend = errors.New("unknown store backend")
+
+// StoredNotification is a notification as held by a store
+// Seq is assigned by the store, starts at 1 and keeps increasing per user,
+// even after notifications are deleted, so it can be used as a resume cursor
+type StoredNotification struct {
+	Seq      int       `json:"seq"`
+	Read     bool      `json:"read"`
+	StoredAt time.Time `json:"storedAt"`
+	models.Notification
+}
+
+// Store persists notifications per user
+// Implementations must be safe for concurrent use
+type Store interface {
+	// Add appends a notification to the user's list and returns it with its sequence number
+	Add(userID string, notification models.Notification) (StoredNotification, error)
+	// List returns all the user's notifications ordered by sequence number
+	List(userID string) ([]StoredNotification, error)
+	// Since returns the user's notifications with a sequence number greater than seq
+	Since(userID string, seq int) ([]StoredNotification, error)
+	// Count returns how many notifications the user has
+	Count(userID string) (int, error)
+	// Delete removes a single notification, returning ErrNotFound if it does not exist
+	Delete(userID string, seq int) error
+	// MarkRead flags the given notifications as read and returns how many changed
+	MarkRead(userID string, seqs ...int) (int, error)
+	// MarkReadUpTo flags every notification with a sequence number up to seq as read
+	MarkReadUpTo(userID string, seq int) (int, error)
+	// UnreadCount returns how many of the user's notifications are unread
+	UnreadCount(userID string) (int, error)
+	// Close releases any resources held by the store
+	Close() error
+}
+
+// Usage reports how much a store holds
+type Usage struct {
+	Users         int   `json:"users"`
+	Notifications int   `json:"notifications"`
+	Bytes         int64 `json:"bytes"`
+}
+
+// Sizer is implemented by stores that can report their usage
+type Sizer interface {
+	// Usage counts the users and notifications held and the bytes they use
+	Usage() (Usage, error)
+}
+
+// Position identifies the Kafka message a notification was read from
+type Position struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+}
+
+// Checkpointer is implemented by durable stores that record the last processed
+// Kafka offset atomically with the notification read from it, so the consumer
+// can resume from its own checkpoint instead of replaying the whole topic
+type Checkpointer interface {
+	// AddAt stores the notification and records pos as processed in one atomic write
+	AddAt(userID string, notification models.Notification, pos Position) (StoredNotification, error)
+	// SetCheckpoint records pos as processed without storing anything, for the
+	// messages that were skipped or dead-lettered
+	SetCheckpoint(pos Position) error
+	// Checkpoint returns the last processed offset of a topic partition, if any
+	Checkpoint(topic string, partition int32) (offset int64, ok bool, err error)
+}
+
+// Open creates the store for the given backend name
+// path is the database file used by the durable backends
+func Open(backend, path string) (Store, error) {
+	switch backend {
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	case BackendBolt:
+		return NewBoltStore(path)
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnknownBackend, backend)
+	}
+}
@@ -0,0 +1,253 @@
+// Package storetest provides a conformance suite that every store.Store
+// implementation must pass. Backends call Run from their own tests:
+//
+//	func TestBoltStore(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Store {
+//			s, err := store.NewBoltStore(filepath.Join(t.TempDir(), "test.db"))
+//			require.NoError(t, err)
+//			return s
+//		})
+//	}
+package storetest
+
+import (
+	"sync"
+	"testing"
+
+	"kafka-notify/pkg/models"
+	"kafka-notify/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Factory creates a new, empty store for a single test
+// The suite closes the store when the test ends
+type Factory func(t *testing.T) store.Store
+
+// Run executes the whole conformance suite against the stores built by newStore
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store)
+	}{
+		{"AddAssignsIncreasingSeq", testAddAssignsIncreasingSeq},
+		{"ListIsPerUserAndOrdered", testListIsPerUserAndOrdered},
+		{"ListEmptyUser", testListEmptyUser},
+		{"Since", testSince},
+		{"Count", testCount},
+		{"Delete", testDelete},
+		{"DeleteKeepsSeqMonotonic", testDeleteKeepsSeqMonotonic},
+		{"MarkRead", testMarkRead},
+		{"MarkReadUpTo", testMarkReadUpTo},
+		{"UnreadCount", testUnreadCount},
+		{"ConcurrentAdd", testConcurrentAdd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newStore(t)
+			t.Cleanup(func() { assert.NoError(t, s.Close()) })
+			tt.fn(t, s)
+		})
+	}
+}
+
+// notification builds a test notification with the given message
+func notification(message string) models.Notification {
+	return models.Notification{
+		From:    models.User{ID: 1, Name: "Micho"},
+		To:      models.User{ID: 2, Name: "Tito"},
+		Message: message,
+	}
+}
+
+// messages returns the messages of the stored notifications in order
+func messages(notes []store.StoredNotification) []string {
+	out := make([]string, 0, len(notes))
+	for _, note := range notes {
+		out = append(out, note.Message)
+	}
+	return out
+}
+
+func testAddAssignsIncreasingSeq(t *testing.T, s store.Store) {
+	first, err := s.Add("2", notification("a"))
+	require.NoError(t, err)
+	second, err := s.Add("2", notification("b"))
+	require.NoError(t, err)
+
+	assert.Equal(t, 1, first.Seq)
+	assert.Equal(t, 2, second.Seq)
+	assert.False(t, first.Read)
+	assert.Equal(t, "a", first.Message)
+}
+
+func testListIsPerUserAndOrdered(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+	_, err := s.Add("3", notification("other"))
+	require.NoError(t, err)
+
+	notes, err := s.List("2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, messages(notes))
+
+	notes, err = s.List("3")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"other"}, messages(notes))
+	assert.Equal(t, 1, notes[0].Seq, "sequence numbers are per user")
+}
+
+func testListEmptyUser(t *testing.T, s store.Store) {
+	notes, err := s.List("unknown")
+	require.NoError(t, err)
+	assert.Empty(t, notes)
+
+	count, err := s.Count("unknown")
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func testSince(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+
+	notes, err := s.Since("2", 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, messages(notes))
+
+	notes, err = s.Since("2", 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"b", "c"}, messages(notes))
+
+	notes, err = s.Since("2", 3)
+	require.NoError(t, err)
+	assert.Empty(t, notes)
+}
+
+func testCount(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+	count, err := s.Count("2")
+	require.NoError(t, err)
+	assert.Equal(t, 2, count)
+}
+
+func testDelete(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+
+	require.NoError(t, s.Delete("2", 2))
+	notes, err := s.List("2")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "c"}, messages(notes))
+
+	assert.ErrorIs(t, s.Delete("2", 2), store.ErrNotFound)
+	assert.ErrorIs(t, s.Delete("unknown", 1), store.ErrNotFound)
+}
+
+func testDeleteKeepsSeqMonotonic(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Delete("2", 2))
+
+	next, err := s.Add("2", notification("c"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, next.Seq, "sequence numbers must never be reused")
+}
+
+func testMarkRead(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+
+	changed, err := s.MarkRead("2", 1, 3, 42)
+	require.NoError(t, err)
+	assert.Equal(t, 2, changed)
+
+	// Marking again is idempotent
+	changed, err = s.MarkRead("2", 1)
+	require.NoError(t, err)
+	assert.Zero(t, changed)
+
+	notes, err := s.List("2")
+	require.NoError(t, err)
+	require.Len(t, notes, 3)
+	assert.True(t, notes[0].Read)
+	assert.False(t, notes[1].Read)
+	assert.True(t, notes[2].Read)
+}
+
+func testMarkReadUpTo(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+	_, err := s.MarkRead("2", 1)
+	require.NoError(t, err)
+
+	changed, err := s.MarkReadUpTo("2", 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, changed, "already read notifications are not counted")
+
+	notes, err := s.List("2")
+	require.NoError(t, err)
+	require.Len(t, notes, 3)
+	assert.True(t, notes[0].Read)
+	assert.True(t, notes[1].Read)
+	assert.False(t, notes[2].Read)
+}
+
+func testUnreadCount(t *testing.T, s store.Store) {
+	for _, msg := range []string{"a", "b", "c"} {
+		_, err := s.Add("2", notification(msg))
+		require.NoError(t, err)
+	}
+	unread, err := s.UnreadCount("2")
+	require.NoError(t, err)
+	assert.Equal(t, 3, unread)
+
+	_, err = s.MarkRead("2", 2)
+	require.NoError(t, err)
+	unread, err = s.UnreadCount("2")
+	require.NoError(t, err)
+	assert.Equal(t, 2, unread)
+
+	unread, err = s.UnreadCount("unknown")
+	require.NoError(t, err)
+	assert.Zero(t, unread)
+}
+
+func testConcurrentAdd(t *testing.T, s store.Store) {
+	const writers, perWriter = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < perWriter; j++ {
+				_, err := s.Add("2", notification("concurrent"))
+				assert.NoError(t, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	notes, err := s.List("2")
+	require.NoError(t, err)
+	require.Len(t, notes, writers*perWriter)
+	for i, note := range notes {
+		assert.Equal(t, i+1, note.Seq, "sequence numbers must be unique and gapless")
+	}
+}